@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"sort"
 
 	"github.com/vishvananda/netlink"
 )
@@ -20,17 +21,62 @@ type Config struct {
 	} `yaml:"server"`
 
 	Crypto struct {
-		Type string `yaml:"type"`
-		Key  string `yaml:"key"`
+		Type           string `yaml:"type"`
+		Key            string `yaml:"key"`
+		KDF            string `yaml:"kdf"`
+		Salt           string `yaml:"salt"`
+		PrivateKeyFile string `yaml:"privateKeyFile"`
+		RekeyInterval  int    `yaml:"rekeyInterval"`
+		RekeyPackets   int    `yaml:"rekeyPackets"`
+		RekeyOverlap   int    `yaml:"rekeyOverlap"`
 	} `yaml:"crypto"`
 
 	Nodes []struct {
 		Node `yaml:"node"`
 	} `yaml:"nodes"`
 
+	Detection struct {
+		TxInterval int `yaml:"txInterval"`
+		Multiplier int `yaml:"multiplier"`
+	} `yaml:"detection"`
+
+	Routing struct {
+		Learn             bool     `yaml:"learn"`
+		Accept            []string `yaml:"accept"`
+		AdvertiseInterval int      `yaml:"advertiseInterval"`
+		ReconcileInterval int      `yaml:"reconcileInterval"`
+		Table             int      `yaml:"table"`
+
+		Rules []struct {
+			Fwmark   int    `yaml:"fwmark"`
+			From     string `yaml:"from"`
+			Priority int    `yaml:"priority"`
+		} `yaml:"rules"`
+
+		Import struct {
+			Table      int      `yaml:"table"`
+			Interfaces []string `yaml:"interfaces"`
+			Metric     int      `yaml:"metric"`
+		} `yaml:"import"`
+	} `yaml:"routing"`
+
+	Relay struct {
+		Address string `yaml:"address"`
+		Listen  string `yaml:"listen"`
+		Token   string `yaml:"token"`
+	} `yaml:"relay"`
+
+	Monitor struct {
+		Address string `yaml:"address"`
+	} `yaml:"monitor"`
+
+	Control struct {
+		Socket string `yaml:"socket"`
+	} `yaml:"control"`
+
 	Etcd struct {
-		Endpoints []string `yaml:endpoints`
-		Timeout   int      `yaml:timeout`
+		Endpoints []string `yaml:"endpoints"`
+		Timeout   int      `yaml:"timeout"`
 	} `yaml:"etcd"`
 
 	Revision int `yaml:"revision"`
@@ -40,10 +86,24 @@ type Config struct {
 
 // Node represents node / host IP configuration
 type Node struct {
-	Name             string   `yaml:"name"`
-	Address          string   `yaml:"address"`
-	PrivateAddresses []string `yaml:"privateAddresses"`
-	PrivateSubnets   []string `yaml:"privateSubnets"`
+	Name             string     `yaml:"name"`
+	Address          string     `yaml:"address"`
+	Port             int        `yaml:"port"`
+	PublicKey        string     `yaml:"publicKey"`
+	Via              string     `yaml:"via"`
+	Exit             bool       `yaml:"exit"`
+	Transit          bool       `yaml:"transit"`
+	Endpoints        []Endpoint `yaml:"endpoints"`
+	PrivateAddresses []string   `yaml:"privateAddresses"`
+	PrivateSubnets   []Subnet   `yaml:"privateSubnets"`
+}
+
+// Endpoint represents an underlay address of a node,
+// the lower priority is preferred
+type Endpoint struct {
+	Address  string `yaml:"address"`
+	Port     int    `yaml:"port"`
+	Priority int    `yaml:"priority"`
 }
 
 type source interface {
@@ -140,21 +200,43 @@ func (c *Config) Watcher(ctx context.Context, extNotify chan struct{}) {
 func (c Config) GetNodesPrivateSubnets() []string {
 	var subnets []string
 	for _, nodes := range c.Nodes {
-		subnets = append(subnets, nodes.Node.PrivateSubnets...)
+		subnets = append(subnets, nodes.Node.GetPrivateSubnets()...)
 	}
 	return subnets
 }
 
-// GetIRB returns information route base
-func (c *Config) GetIRB() map[string][]string {
-	irb := make(map[string][]string)
+// GetIRB returns information route base, the subnets by the node address,
+// an exit node has the default routes as well
+func (c *Config) GetIRB() map[string][]Subnet {
+	irb := make(map[string][]Subnet)
 	for _, nodes := range c.Nodes {
-		irb[nodes.Node.Address] = nodes.Node.PrivateSubnets
+		subnets := nodes.Node.PrivateSubnets
+		if nodes.Node.Exit {
+			subnets = append(subnets[:len(subnets):len(subnets)],
+				Subnet{Prefix: "0.0.0.0/0"}, Subnet{Prefix: "::/0"})
+		}
+		irb[nodes.Node.Address] = subnets
 	}
 
 	return irb
 }
 
+// GetCryptoKey returns the crypto key, the key can be a reference
+// to a file, an environment variable or a vault secret
+func (c Config) GetCryptoKey() (string, error) {
+	return resolveKey(c.Crypto.Key)
+}
+
+// GetRelayToken returns the relay server token, the token can be
+// a reference to a file, an environment variable or a vault secret
+func (c Config) GetRelayToken() (string, error) {
+	if c.Relay.Token == "" {
+		return "", errors.New("relay token is not configured")
+	}
+
+	return resolveKey(c.Relay.Token)
+}
+
 // Whoami returns current node config
 func (c Config) Whoami() (Node, error) {
 	// if the server name exist at env
@@ -186,8 +268,10 @@ func (c Config) Whoami() (Node, error) {
 
 	for _, nodes := range c.Nodes {
 		for _, ip := range ipList {
-			if nodes.Node.Address == ip {
-				return nodes.Node, nil
+			for _, endpoint := range nodes.Node.GetEndpoints() {
+				if endpoint.Address == ip {
+					return nodes.Node, nil
+				}
 			}
 		}
 	}
@@ -197,7 +281,27 @@ func (c Config) Whoami() (Node, error) {
 
 // GetPrivateSubnets gets the node's private subnets
 func (n Node) GetPrivateSubnets() []string {
-	return n.PrivateSubnets
+	var subnets []string
+	for _, subnet := range n.PrivateSubnets {
+		subnets = append(subnets, subnet.Prefix)
+	}
+	return subnets
+}
+
+// GetEndpoints returns the node's endpoints sorted by the priority,
+// it's the node's address and port if there isn't any endpoint
+func (n Node) GetEndpoints() []Endpoint {
+	if len(n.Endpoints) == 0 {
+		return []Endpoint{{Address: n.Address, Port: n.Port}}
+	}
+
+	endpoints := make([]Endpoint, len(n.Endpoints))
+	copy(endpoints, n.Endpoints)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+
+	return endpoints
 }
 
 // GetPrivateAddresses gets the node's private addresses
@@ -237,4 +341,32 @@ func setDefaultConfig(c *Config) {
 	if c.Server.Mtu == 0 {
 		c.Server.Mtu = 1300
 	}
+
+	if c.Crypto.RekeyInterval == 0 {
+		c.Crypto.RekeyInterval = 120
+	}
+
+	if c.Crypto.RekeyPackets == 0 {
+		c.Crypto.RekeyPackets = 1 << 30
+	}
+
+	if c.Crypto.RekeyOverlap == 0 {
+		c.Crypto.RekeyOverlap = 30
+	}
+
+	if c.Detection.Multiplier == 0 {
+		c.Detection.Multiplier = 3
+	}
+
+	if c.Routing.AdvertiseInterval == 0 {
+		c.Routing.AdvertiseInterval = 30
+	}
+
+	if c.Routing.ReconcileInterval == 0 {
+		c.Routing.ReconcileInterval = 30
+	}
+
+	if c.Relay.Listen == "" {
+		c.Relay.Listen = ":8087"
+	}
 }
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestGetEndpoints(t *testing.T) {
+	var node Node
+	err := yaml.Unmarshal([]byte(`
+name: node1
+address: 192.168.55.20
+port: 8086
+`), &node)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	endpoints := node.GetEndpoints()
+	if len(endpoints) != 1 || endpoints[0].Address != "192.168.55.20" || endpoints[0].Port != 8086 {
+		t.Error("expected 192.168.55.20:8086 but got,", endpoints)
+	}
+
+	err = yaml.Unmarshal([]byte(`
+name: node1
+address: 192.168.55.20
+endpoints:
+  - address: 2001:db8::20
+    priority: 20
+  - address: 192.168.55.20
+    port: 8086
+    priority: 10
+`), &node)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	endpoints = node.GetEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Address != "192.168.55.20" || endpoints[1].Address != "2001:db8::20" {
+		t.Error("expected the endpoints by the priority but got,", endpoints)
+	}
+}
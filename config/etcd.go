@@ -88,6 +88,10 @@ func (e *etcd) load() (*Config, error) {
 
 func (e etcd) putConfig(cfg *Config) error {
 	base := "/radvpn/"
+
+	if cfg.Crypto.Key != "" && !isKeyRef(cfg.Crypto.Key) {
+		log.Println("warning: crypto key is stored at etcd in plain text, use a file, env or vault reference")
+	}
 	config, err := yaml.Marshal(cfg)
 	if err != nil {
 		return err
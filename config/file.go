@@ -77,6 +77,10 @@ func (f file) watch(ctx context.Context, notify chan struct{}) {
 
 			stat, err := os.Stat(f.cfile)
 			if err != nil {
+				// the file might be removed once the watch is canceled
+				if ctx.Err() != nil {
+					return
+				}
 				log.Fatal(err)
 			}
 
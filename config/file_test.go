@@ -34,7 +34,7 @@ nodes:
         - 10.0.2.0/24
 `
 
-func TestiFileLoad(t *testing.T) {
+func TestFileLoad(t *testing.T) {
 	tf, err := ioutil.TempFile("", "")
 	if err != nil {
 		t.Error(err)
@@ -89,13 +89,18 @@ func TestFileWatch(t *testing.T) {
 		watchDelay: 1,
 	}
 
+	// the watcher stops before the file is removed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	notify := make(chan struct{}, 1)
-	f.watch(context.Background(), notify)
+	f.watch(ctx, notify)
 	time.Sleep(1 * time.Second)
 	tf.WriteString(cfgT)
-	time.Sleep(1 * time.Second)
 
-	if len(notify) != 1 {
+	select {
+	case <-notify:
+	case <-time.After(3 * time.Second):
 		t.Error("expected notifcation but got nothing")
 	}
 }
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// keyProvider resolves a secret based on its reference
+type keyProvider interface {
+	resolve(ref string) (string, error)
+}
+
+// keyProviders are the secret providers by the reference scheme:
+//
+//	file:/etc/radvpn/key
+//	env:RADVPN_KEY
+//	vault:https://127.0.0.1:8200/v1/secret/data/radvpn#key
+//	vault:secret/data/radvpn#key (based on VAULT_ADDR)
+var keyProviders = map[string]keyProvider{
+	"file":  fileKey{},
+	"env":   envKey{},
+	"vault": vaultKey{client: &http.Client{Timeout: 5 * time.Second}},
+}
+
+type fileKey struct{}
+
+type envKey struct{}
+
+type vaultKey struct {
+	client *http.Client
+}
+
+// resolveKey returns the secret of the reference, a value
+// without a known scheme is the secret itself
+func resolveKey(ref string) (string, error) {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return ref, nil
+	}
+
+	p, ok := keyProviders[ref[:i]]
+	if !ok {
+		return ref, nil
+	}
+
+	key, err := p.resolve(ref[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("key %s: %v", ref[:i], err)
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("key %s: empty secret", ref[:i])
+	}
+
+	return key, nil
+}
+
+// isKeyRef reports whether the value is a reference to a secret
+func isKeyRef(ref string) bool {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return false
+	}
+
+	_, ok := keyProviders[ref[:i]]
+
+	return ok
+}
+
+func (fileKey) resolve(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (envKey) resolve(name string) (string, error) {
+	key, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s not found", name)
+	}
+
+	return key, nil
+}
+
+// resolve reads the field from a vault compatible kv secret, the token
+// is read from VAULT_TOKEN and the field is the url fragment (default is key)
+func (v vaultKey) resolve(ref string) (string, error) {
+	field := "key"
+	if i := strings.LastIndex(ref, "#"); i > 0 {
+		field = ref[i+1:]
+		ref = ref[:i]
+	}
+
+	url := ref
+	if !strings.HasPrefix(ref, "http://") && !strings.HasPrefix(ref, "https://") {
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			return "", errors.New("VAULT_ADDR is not set")
+		}
+		url = strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(ref, "/")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	// kv version 2 nests the secret in data.data
+	secret := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	key, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault field %s not found", field)
+	}
+
+	return key, nil
+}
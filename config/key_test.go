@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResolveKey(t *testing.T) {
+	tf, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(tf.Name())
+
+	tf.WriteString("filekey\n")
+
+	os.Setenv("RADVPN_TEST_KEY", "envkey")
+	defer os.Unsetenv("RADVPN_TEST_KEY")
+
+	for ref, expected := range map[string]string{
+		"6368616e6765":          "6368616e6765",
+		"file:" + tf.Name():     "filekey",
+		"env:RADVPN_TEST_KEY":   "envkey",
+		"unknown:secret":        "unknown:secret",
+		"correct horse battery": "correct horse battery",
+	} {
+		key, err := resolveKey(ref)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", ref, err)
+		}
+
+		if key != expected {
+			t.Errorf("expected %s but got, %s", expected, key)
+		}
+	}
+
+	for _, ref := range []string{"file:/notexist/radvpn", "env:RADVPN_NOT_EXIST"} {
+		if _, err := resolveKey(ref); err == nil {
+			t.Errorf("%s: expected error but got nil", ref)
+		}
+	}
+
+	if !isKeyRef("env:RADVPN_TEST_KEY") || isKeyRef("6368616e6765") {
+		t.Error("unexpected key reference detection")
+	}
+}
+
+func TestResolveVaultKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "mytoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/radvpn":
+			fmt.Fprint(w, `{"data":{"data":{"key":"vaultkey2"}}}`)
+		case "/v1/kv/radvpn":
+			fmt.Fprint(w, `{"data":{"psk":"vaultkey1"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	os.Setenv("VAULT_TOKEN", "mytoken")
+	os.Setenv("VAULT_ADDR", ts.URL)
+	defer os.Unsetenv("VAULT_TOKEN")
+	defer os.Unsetenv("VAULT_ADDR")
+
+	key, err := resolveKey("vault:" + ts.URL + "/v1/secret/data/radvpn")
+	if err != nil || key != "vaultkey2" {
+		t.Error("expected vaultkey2 but got,", key, err)
+	}
+
+	key, err = resolveKey("vault:kv/radvpn#psk")
+	if err != nil || key != "vaultkey1" {
+		t.Error("expected vaultkey1 but got,", key, err)
+	}
+
+	if _, err := resolveKey("vault:kv/notexist"); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	os.Setenv("VAULT_TOKEN", "wrong")
+	if _, err := resolveKey("vault:kv/radvpn#psk"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
@@ -0,0 +1,50 @@
+package config
+
+// Subnet represents a private subnet of a node, the nodes which
+// announce the same subnet with the lowest metric share its traffic
+// based on the weights, the higher metrics are the standby nodes.
+// it can be configured as a prefix or as a prefix and its options:
+//
+//	privateSubnets:
+//	  - 10.0.1.0/24
+//	  - prefix: 10.0.2.0/24
+//	    weight: 3
+//	    metric: 100
+type Subnet struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Metric int    `yaml:"metric,omitempty" json:"metric,omitempty"`
+}
+
+// UnmarshalYAML decodes a prefix or a prefix and its options
+func (s *Subnet) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var prefix string
+	if err := unmarshal(&prefix); err == nil {
+		*s = Subnet{Prefix: prefix}
+		return nil
+	}
+
+	type subnet Subnet
+
+	return unmarshal((*subnet)(s))
+}
+
+// MarshalYAML encodes the subnet without options as a prefix
+func (s Subnet) MarshalYAML() (interface{}, error) {
+	if s.Weight == 0 && s.Metric == 0 {
+		return s.Prefix, nil
+	}
+
+	type subnet Subnet
+
+	return subnet(s), nil
+}
+
+// GetWeight returns the weight, the default weight is one
+func (s Subnet) GetWeight() int {
+	if s.Weight < 1 {
+		return 1
+	}
+
+	return s.Weight
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSubnetUnmarshal(t *testing.T) {
+	var node Node
+
+	err := yaml.Unmarshal([]byte(`
+privateSubnets:
+  - 10.0.1.0/24
+  - prefix: 10.0.2.0/24
+    weight: 3
+    metric: 100
+`), &node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node.PrivateSubnets) != 2 {
+		t.Fatal("expected 2 subnets but got,", len(node.PrivateSubnets))
+	}
+
+	if s := node.PrivateSubnets[0]; s.Prefix != "10.0.1.0/24" || s.GetWeight() != 1 {
+		t.Error("expected 10.0.1.0/24 weight 1 but got,", s)
+	}
+
+	if s := node.PrivateSubnets[1]; s.Prefix != "10.0.2.0/24" || s.GetWeight() != 3 || s.Metric != 100 {
+		t.Error("expected 10.0.2.0/24 weight 3 metric 100 but got,", s)
+	}
+
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Node
+	yaml.Unmarshal(b, &decoded)
+
+	if len(decoded.PrivateSubnets) != 2 || decoded.PrivateSubnets[1] != node.PrivateSubnets[1] {
+		t.Error("unexpected subnets after marshal,", decoded.PrivateSubnets)
+	}
+}
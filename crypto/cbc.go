@@ -4,57 +4,94 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
-	"encoding/hex"
+	"crypto/sha256"
 	"errors"
 	"io"
+
+	"golang.org/x/crypto/hkdf"
 )
 
-// CBC represents block cipher mode of operation algorithm
+// CBC represents block cipher mode of operation algorithm,
+// it's authenticated by HMAC-SHA256 as encrypt-then-MAC
 type CBC struct {
 	Passphrase string
+	KDF        string
+	Salt       string
 	key        []byte
+	macKey     []byte
+
+	// block is built once and it's safe for concurrent use
+	block cipher.Block
 }
 
 // Init initializes the key based on the passphrase
-func (c *CBC) Init() {
-	c.key, _ = hex.DecodeString(c.Passphrase)
+func (c *CBC) Init() error {
+	key, err := deriveKey(c.Passphrase, c.KDF, c.Salt, 32)
+	if err != nil {
+		return err
+	}
+
+	return c.setKey(key)
+}
+
+// setKey derives the encryption and the authentication keys
+// and builds the block cipher
+func (c *CBC) setKey(key []byte) error {
+	if err := checkAESKey(key); err != nil {
+		return err
+	}
+
+	c.key = make([]byte, len(key))
+	c.macKey = make([]byte, sha256.Size)
+
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("radvpn cbc encryption")), c.key)
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("radvpn cbc authentication")), c.macKey)
+
+	var err error
+	c.block, err = aes.NewCipher(c.key)
+
+	return err
 }
 
 // Encrypt encrypts the plaindat
 func (c CBC) Encrypt(plainData []byte) ([]byte, error) {
-	if len(plainData)%aes.BlockSize != 0 {
-		plainData = padding(plainData)
+	if c.block == nil {
+		return nil, errNotInitialized
 	}
 
-	block, err := aes.NewCipher(c.key)
-	if err != nil {
-		return nil, err
-	}
+	plainData = padding(plainData)
 
-	cipherData := make([]byte, aes.BlockSize+len(plainData))
+	cipherData := make([]byte, aes.BlockSize+len(plainData), aes.BlockSize+len(plainData)+sha256.Size)
 	iv := cipherData[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return nil, err
 	}
 
-	mode := cipher.NewCBCEncrypter(block, iv)
+	mode := cipher.NewCBCEncrypter(c.block, iv)
 	mode.CryptBlocks(cipherData[aes.BlockSize:], plainData)
 
-	return cipherData, nil
+	return append(cipherData, c.mac(cipherData)...), nil
 }
 
 // Decrypt decrypts the cipherdat
 func (c CBC) Decrypt(cipherData []byte) ([]byte, error) {
-	block, err := aes.NewCipher(c.key)
-	if err != nil {
-		return nil, err
+	if c.block == nil {
+		return nil, errNotInitialized
 	}
 
-	if len(cipherData) < aes.BlockSize {
+	if len(cipherData) < 2*aes.BlockSize+sha256.Size {
 		return nil, errors.New("encrypted data is too short")
 	}
 
+	tag := cipherData[len(cipherData)-sha256.Size:]
+	cipherData = cipherData[:len(cipherData)-sha256.Size]
+
+	if !hmac.Equal(tag, c.mac(cipherData)) {
+		return nil, errors.New("message authentication failed")
+	}
+
 	iv := cipherData[:aes.BlockSize]
 	cipherData = cipherData[aes.BlockSize:]
 
@@ -62,19 +99,30 @@ func (c CBC) Decrypt(cipherData []byte) ([]byte, error) {
 		return nil, errors.New("invalid size")
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(cipherData, cipherData)
+	plainData := make([]byte, len(cipherData))
+	mode := cipher.NewCBCDecrypter(c.block, iv)
+	mode.CryptBlocks(plainData, cipherData)
 
-	cipherData, _ = unpadding(cipherData)
+	return unpadding(plainData)
+}
 
-	return cipherData, nil
+// mac returns HMAC-SHA256 of the iv and the cipherdata
+func (c CBC) mac(b []byte) []byte {
+	h := hmac.New(sha256.New, c.macKey)
+	h.Write(b)
+	return h.Sum(nil)
 }
 
+// padding pads the data by PKCS#7, it always adds at least one byte
+// tools.ietf.org/html/rfc5652#section-6.3
 func padding(b []byte) []byte {
 	padLen := aes.BlockSize - (len(b) % aes.BlockSize)
 	pad := bytes.Repeat([]byte{byte(padLen)}, padLen)
 
-	return append(b, pad...)
+	padded := make([]byte, len(b), len(b)+padLen)
+	copy(padded, b)
+
+	return append(padded, pad...)
 }
 
 func unpadding(b []byte) ([]byte, error) {
@@ -87,7 +135,7 @@ func unpadding(b []byte) ([]byte, error) {
 	pad := b[len(b)-1]
 	padLen := int(pad)
 
-	if padLen > bLen || padLen > aes.BlockSize {
+	if padLen == 0 || padLen > bLen || padLen > aes.BlockSize {
 		return b, errors.New("invalid padding size")
 	}
 
@@ -10,7 +10,9 @@ func TestCryptoCBC(t *testing.T) {
 		Passphrase: "6368616e676520746869732070617373776f726420746f206120736563726574",
 	}
 
-	c.Init()
+	if err := c.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
 
 	msg := "decentralized vpn"
 
@@ -61,3 +63,84 @@ func TestUnpadding(t *testing.T) {
 		t.Error("unexpected padded result")
 	}
 }
+
+func TestCryptoCBCTampered(t *testing.T) {
+	c := &CBC{
+		Passphrase: "6368616e676520746869732070617373776f726420746f206120736563726574",
+	}
+
+	if err := c.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	emsg, err := c.Encrypt([]byte("decentralized vpn"))
+	if err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	// iv, cipherdata and mac
+	for _, i := range []int{0, aes.BlockSize + 1, len(emsg) - 1} {
+		b := append([]byte{}, emsg...)
+		b[i] ^= 0x01
+
+		if _, err := c.Decrypt(b); err == nil {
+			t.Errorf("expected error for tampered byte %d but got nil", i)
+		}
+	}
+
+	if _, err := c.Decrypt(emsg[:len(emsg)-aes.BlockSize]); err == nil {
+		t.Error("expected error for truncated data but got nil")
+	}
+
+	other := &CBC{
+		Passphrase: "7368616e676520746869732070617373776f726420746f206120736563726574",
+	}
+
+	if err := other.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	if _, err := other.Decrypt(emsg); err == nil {
+		t.Error("expected error for wrong key but got nil")
+	}
+}
+
+func TestCryptoCBCBlockSize(t *testing.T) {
+	c := &CBC{
+		Passphrase: "6368616e676520746869732070617373776f726420746f206120736563726574",
+	}
+
+	if err := c.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	// the last byte looks like a padding
+	msg := []byte("decentralized.\x01\x01")
+
+	emsg, err := c.Encrypt(msg)
+	if err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	dmsg, err := c.Decrypt(emsg)
+	if err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	if string(dmsg) != string(msg) {
+		t.Errorf("expected %q but got, %q", msg, dmsg)
+	}
+}
+
+func TestUnpaddingInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		[]byte("vpn\x00"),
+		[]byte("vpn\x11"),
+		[]byte("vp\x03\x02\x03"),
+	} {
+		if _, err := unpadding(b); err == nil {
+			t.Errorf("expected error for %q but got nil", b)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChaCha20Poly1305 represents ChaCha20-Poly1305 AEAD, it's faster than
+// GCM on the platforms without AES hardware acceleration
+// tools.ietf.org/html/rfc8439
+type ChaCha20Poly1305 struct {
+	Passphrase string
+	KDF        string
+	Salt       string
+	key        []byte
+
+	// aead is built once and it's safe for concurrent use
+	aead cipher.AEAD
+}
+
+// Init initializes the key based on the passphrase
+func (c *ChaCha20Poly1305) Init() error {
+	key, err := deriveKey(c.Passphrase, c.KDF, c.Salt, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+
+	return c.setKey(key)
+}
+
+// setKey builds the AEAD by the key
+func (c *ChaCha20Poly1305) setKey(key []byte) error {
+	if len(key) != chacha20poly1305.KeySize {
+		return fmt.Errorf("invalid key size %d bytes, chacha20 requires %d bytes",
+			len(key), chacha20poly1305.KeySize)
+	}
+
+	var err error
+	c.aead, err = chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+
+	c.key = key
+
+	return nil
+}
+
+// Encrypt encrypts the plaindata
+func (c ChaCha20Poly1305) Encrypt(plainData []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, errNotInitialized
+	}
+
+	nonceSize := c.aead.NonceSize()
+	nonce := make([]byte, nonceSize, nonceSize+len(plainData)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, plainData, nil), nil
+}
+
+// Decrypt decrypts the cipherdata
+func (c ChaCha20Poly1305) Decrypt(cipherData []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, errNotInitialized
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(cipherData) < nonceSize {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	nonce, cipherData := cipherData[:nonceSize], cipherData[nonceSize:]
+	plainData, err := c.aead.Open(nil, nonce, cipherData, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return plainData, nil
+}
@@ -0,0 +1,38 @@
+package crypto
+
+import "testing"
+
+func TestCryptoChaCha20Poly1305(t *testing.T) {
+	c := &ChaCha20Poly1305{
+		Passphrase: "6368616e676520746869732070617373776f726420746f206120736563726574",
+	}
+
+	if err := c.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
+
+	msg := "decentralized vpn"
+
+	emsg, err := c.Encrypt([]byte(msg))
+	if err != nil {
+		t.Error("unexpected error happened:", err)
+	}
+
+	dmsg, err := c.Decrypt(emsg)
+	if err != nil {
+		t.Error("unexpected error happened:", err)
+	}
+
+	if string(dmsg) != msg {
+		t.Errorf("expected %s but got, %s", msg, string(dmsg))
+	}
+
+	emsg[len(emsg)-1] ^= 0xff
+	if _, err := c.Decrypt(emsg); err == nil {
+		t.Error("expected error for tampered data but got nil")
+	}
+
+	if _, err := c.Decrypt(emsg[:4]); err == nil {
+		t.Error("expected error for short data but got nil")
+	}
+}
@@ -9,7 +9,35 @@ import (
 type Cipher interface {
 	Encrypt([]byte) ([]byte, error)
 	Decrypt([]byte) ([]byte, error)
-	Init()
+	Init() error
+}
+
+// NewCipher constructs a cipher by its type name with a raw key
+func NewCipher(name string, key []byte) (Cipher, error) {
+	var (
+		c   Cipher
+		err error
+	)
+
+	switch name {
+	case "gcm":
+		g := &GCM{}
+		c, err = g, g.setKey(key)
+	case "cbc":
+		b := &CBC{}
+		c, err = b, b.setKey(key)
+	case "chacha20":
+		p := &ChaCha20Poly1305{}
+		c, err = p, p.setKey(key)
+	default:
+		return nil, errors.New("crypto not support")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
 }
 
 // Pbkdf1 applies a hash function, which shall be SHA-1 to derive keys
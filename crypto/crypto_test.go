@@ -0,0 +1,134 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+const benchPacketSize = 1300
+
+func TestNewCipher(t *testing.T) {
+	key := make([]byte, KeySize)
+
+	for _, name := range []string{"gcm", "cbc", "chacha20"} {
+		c, err := NewCipher(name, key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+
+		emsg, _ := c.Encrypt([]byte("vpn"))
+		dmsg, err := c.Decrypt(emsg)
+		if err != nil || string(dmsg) != "vpn" {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+
+		if _, err := NewCipher(name, key[:10]); err == nil {
+			t.Errorf("%s: expected invalid key error but got nil", name)
+		}
+	}
+
+	if _, err := NewCipher("unknown", key); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestUninitializedCipher(t *testing.T) {
+	for _, c := range []Cipher{&GCM{}, &CBC{}, &ChaCha20Poly1305{}} {
+		if _, err := c.Encrypt([]byte("vpn")); err != errNotInitialized {
+			t.Errorf("%T: expected not initialized error but got, %v", c, err)
+		}
+	}
+}
+
+// benchmarkCipher reports the packets/s of encrypt and decrypt, the
+// workers run in parallel like the server workers
+func benchmarkCipher(b *testing.B, c Cipher) {
+	packet := make([]byte, benchPacketSize)
+
+	b.SetBytes(benchPacketSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			emsg, err := c.Encrypt(packet)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := c.Decrypt(emsg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+func BenchmarkGCM(b *testing.B) {
+	c, _ := NewCipher("gcm", make([]byte, KeySize))
+	benchmarkCipher(b, c)
+}
+
+func BenchmarkCBC(b *testing.B) {
+	c, _ := NewCipher("cbc", make([]byte, KeySize))
+	benchmarkCipher(b, c)
+}
+
+func BenchmarkChaCha20Poly1305(b *testing.B) {
+	c, _ := NewCipher("chacha20", make([]byte, KeySize))
+	benchmarkCipher(b, c)
+}
+
+// perPacketGCM builds the AEAD for every packet, it's the
+// baseline for BenchmarkGCM
+type perPacketGCM struct {
+	key []byte
+}
+
+func (g perPacketGCM) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(g.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (g perPacketGCM) Encrypt(plainData []byte) ([]byte, error) {
+	aead, err := g.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plainData, nil), nil
+}
+
+func (g perPacketGCM) Decrypt(cipherData []byte) ([]byte, error) {
+	aead, err := g.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+
+	return aead.Open(nil, cipherData[:nonceSize], cipherData[nonceSize:], nil)
+}
+
+func (g perPacketGCM) Init() error {
+	return nil
+}
+
+func BenchmarkGCMPerPacket(b *testing.B) {
+	benchmarkCipher(b, perPacketGCM{key: make([]byte, KeySize)})
+}
@@ -4,56 +4,82 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/hex"
+	"errors"
 	"io"
 )
 
+var errNotInitialized = errors.New("cipher is not initialized")
+
 // GCM represents Galois/Counter Mode
 type GCM struct {
 	Passphrase string
+	KDF        string
+	Salt       string
 	key        []byte
+
+	// aead is built once and it's safe for concurrent use
+	aead cipher.AEAD
 }
 
 // Init initializes the key based on the passphrase
-func (g *GCM) Init() {
-	g.key, _ = hex.DecodeString(g.Passphrase)
+func (g *GCM) Init() error {
+	key, err := deriveKey(g.Passphrase, g.KDF, g.Salt, 32)
+	if err != nil {
+		return err
+	}
+
+	return g.setKey(key)
 }
 
-// Encrypt encrypts the plaindata
-func (g GCM) Encrypt(plainData []byte) ([]byte, error) {
-	block, err := aes.NewCipher(g.key)
+// setKey builds the AEAD by the key
+func (g *GCM) setKey(key []byte) error {
+	if err := checkAESKey(key); err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	g.aead, err = cipher.NewGCM(block)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
+	g.key = key
+
+	return nil
+}
+
+// Encrypt encrypts the plaindata
+func (g GCM) Encrypt(plainData []byte) ([]byte, error) {
+	if g.aead == nil {
+		return nil, errNotInitialized
+	}
+
+	nonceSize := g.aead.NonceSize()
+	nonce := make([]byte, nonceSize, nonceSize+len(plainData)+g.aead.Overhead())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plainData, nil), nil
+	return g.aead.Seal(nonce, nonce, plainData, nil), nil
 }
 
 // Decrypt decrypts the cipherdata
 func (g GCM) Decrypt(cipherData []byte) ([]byte, error) {
-	block, err := aes.NewCipher(g.key)
-	if err != nil {
-		return nil, err
+	if g.aead == nil {
+		return nil, errNotInitialized
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	nonceSize := g.aead.NonceSize()
+	if len(cipherData) < nonceSize {
+		return nil, errors.New("encrypted data is too short")
 	}
 
-	nonceSize := gcm.NonceSize()
 	nonce, cipherData := cipherData[:nonceSize], cipherData[nonceSize:]
-	plainData, err := gcm.Open(nil, nonce, cipherData, nil)
+	plainData, err := g.aead.Open(nil, nonce, cipherData, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -7,7 +7,9 @@ func TestCryptoGCM(t *testing.T) {
 		Passphrase: "6368616e676520746869732070617373776f726420746f206120736563726574",
 	}
 
-	crp.Init()
+	if err := crp.Init(); err != nil {
+		t.Fatal("unexpected error happened:", err)
+	}
 
 	msg := "decentralized vpn"
 
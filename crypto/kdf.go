@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// argon2id parameters, the second recommended option
+// tools.ietf.org/html/draft-irtf-cfrg-argon2-09#section-7.4
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// defaultSalt is used by hkdf once the salt is not configured,
+// argon2id requires a salt as the passphrases have low entropy and
+// the same passphrase would derive the same key at all deployments
+const defaultSalt = "radvpn"
+
+// deriveKey returns the key based on the passphrase and the kdf:
+//
+//	"" the passphrase is the hex encoded key
+//	argon2id derives the key from a human passphrase
+//	hkdf derives the key from a high entropy secret
+func deriveKey(passphrase, kdf, salt string, keyLen int) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty key")
+	}
+
+	if salt == "" {
+		if kdf == "argon2id" {
+			return nil, errors.New("argon2id requires a salt")
+		}
+		salt = defaultSalt
+	}
+
+	switch kdf {
+	case "":
+		key, err := hex.DecodeString(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex key: %v", err)
+		}
+		return key, nil
+	case "argon2id":
+		return argon2.IDKey([]byte(passphrase), []byte(salt),
+			argon2Time, argon2Memory, argon2Threads, uint32(keyLen)), nil
+	case "hkdf":
+		key := make([]byte, keyLen)
+		r := hkdf.New(sha256.New, []byte(passphrase), []byte(salt), []byte("radvpn key"))
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("kdf %s not support", kdf)
+}
+
+// checkAESKey validates the key size for AES-128, AES-192 or AES-256
+func checkAESKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+
+	return fmt.Errorf("invalid key size %d bytes, AES requires 16, 24 or 32 bytes", len(key))
+}
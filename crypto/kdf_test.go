@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	key, err := deriveKey("6368616e676520746869732070617373776f726420746f206120736563726574", "", "", 32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if string(key) != "change this password to a secret" {
+		t.Error("unexpected hex key", string(key))
+	}
+
+	if _, err := deriveKey("mykey", "", "", 32); err == nil {
+		t.Error("expected invalid hex error but got nil")
+	}
+
+	if _, err := deriveKey("", "argon2id", "", 32); err == nil {
+		t.Error("expected empty key error but got nil")
+	}
+
+	if _, err := deriveKey("mykey", "argon2id", "", 32); err == nil {
+		t.Error("expected no salt error but got nil")
+	}
+
+	if _, err := deriveKey("mykey", "unknown", "", 32); err == nil {
+		t.Error("expected unknown kdf error but got nil")
+	}
+
+	for _, kdf := range []string{"argon2id", "hkdf"} {
+		k1, err := deriveKey("correct horse battery staple", kdf, "mesh1", 32)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+
+		k2, _ := deriveKey("correct horse battery staple", kdf, "mesh1", 32)
+		k3, _ := deriveKey("correct horse battery staple", kdf, "mesh2", 32)
+
+		if len(k1) != 32 {
+			t.Errorf("%s: expected 32 bytes key but got, %d", kdf, len(k1))
+		}
+
+		if !bytes.Equal(k1, k2) {
+			t.Errorf("%s: expected same derived key", kdf)
+		}
+
+		if bytes.Equal(k1, k3) {
+			t.Errorf("%s: expected different key by salt", kdf)
+		}
+	}
+}
+
+func TestInitKeySize(t *testing.T) {
+	for _, c := range []Cipher{
+		&GCM{Passphrase: "6368616e6765"},
+		&CBC{Passphrase: "6368616e6765"},
+		&ChaCha20Poly1305{Passphrase: "6368616e676520746869732070617373"},
+		&GCM{Passphrase: "mykey"},
+	} {
+		if err := c.Init(); err == nil {
+			t.Errorf("expected invalid key error for %T but got nil", c)
+		}
+	}
+
+	// AES-128
+	g := &GCM{Passphrase: "6368616e676520746869732070617373"}
+	if err := g.Init(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	c := &ChaCha20Poly1305{Passphrase: "correct horse battery staple", KDF: "argon2id", Salt: "mesh1"}
+	if err := c.Init(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	msg := "decentralized vpn"
+	emsg, _ := c.Encrypt([]byte(msg))
+	dmsg, err := c.Decrypt(emsg)
+	if err != nil || string(dmsg) != msg {
+		t.Error("unexpected error:", err)
+	}
+}
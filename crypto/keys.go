@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeySize is the size of the X25519 keys
+const KeySize = 32
+
+// PrivateKey represents a X25519 private key
+type PrivateKey [KeySize]byte
+
+// PublicKey represents a X25519 public key
+type PublicKey [KeySize]byte
+
+// GeneratePrivateKey generates a new random X25519 private key
+func GeneratePrivateKey() (PrivateKey, error) {
+	var k PrivateKey
+
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return k, err
+	}
+
+	k.clamp()
+
+	return k, nil
+}
+
+// ParsePrivateKey decodes a base64 encoded private key
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	var k PrivateKey
+
+	err := parseKey(s, k[:])
+	if err != nil {
+		return k, err
+	}
+
+	k.clamp()
+
+	return k, nil
+}
+
+// ParsePublicKey decodes a base64 encoded public key
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+
+	err := parseKey(s, k[:])
+
+	return k, err
+}
+
+// ReadPrivateKeyFile reads a base64 encoded private key from the file,
+// the file shouldn't be accessible by group or others
+func ReadPrivateKeyFile(path string) (PrivateKey, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+
+	if stat.Mode().Perm()&0077 != 0 {
+		return PrivateKey{}, fmt.Errorf("private key file %s permissions %#o are too open", path, stat.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+
+	return ParsePrivateKey(strings.TrimSpace(string(b)))
+}
+
+// WritePrivateKeyFile writes the base64 encoded private key to
+// a new file which is only accessible by the owner
+func WritePrivateKeyFile(path string, k PrivateKey) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(f, k.String())
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Public returns the public key of the private key
+func (k PrivateKey) Public() PublicKey {
+	var p PublicKey
+
+	curve25519.ScalarBaseMult((*[KeySize]byte)(&p), (*[KeySize]byte)(&k))
+
+	return p
+}
+
+// String returns the base64 encoded private key
+func (k PrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// String returns the base64 encoded public key
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// IsZero reports whether the key is not set
+func (k PublicKey) IsZero() bool {
+	return k == PublicKey{}
+}
+
+func (k *PrivateKey) clamp() {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
+
+// dh performs X25519 between the private key and the public key
+func (k PrivateKey) dh(p PublicKey) ([]byte, error) {
+	return curve25519.X25519(k[:], p[:])
+}
+
+func parseKey(s string, k []byte) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	if len(b) != KeySize {
+		return errors.New("invalid key size")
+	}
+
+	copy(k, b)
+
+	return nil
+}
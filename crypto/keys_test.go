@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	k, _ := GeneratePrivateKey()
+
+	pk, err := ParsePrivateKey(k.String())
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if pk != k {
+		t.Error("expected same private key")
+	}
+
+	pub, err := ParsePublicKey(k.Public().String())
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if pub != k.Public() {
+		t.Error("expected same public key")
+	}
+
+	if _, err := ParsePublicKey("bXlrZXk="); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestPrivateKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	k, _ := GeneratePrivateKey()
+	path := filepath.Join(dir, "radvpn.key")
+
+	if err := WritePrivateKeyFile(path, k); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if err := WritePrivateKeyFile(path, k); err == nil {
+		t.Error("expected error for existing file but got nil")
+	}
+
+	rk, err := ReadPrivateKeyFile(path)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if rk != k {
+		t.Error("expected same private key")
+	}
+
+	os.Chmod(path, 0644)
+	if _, err := ReadPrivateKeyFile(path); err == nil {
+		t.Error("expected permissions error but got nil")
+	}
+}
@@ -0,0 +1,313 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	noiseProtocol = "Noise_IK_25519_AESGCM_SHA256"
+	noisePrologue = "radvpn"
+
+	tagSize = 16
+)
+
+// Handshake represents the state of a Noise IK handshake
+// noiseprotocol.org/noise.html#interactive-handshake-patterns-fundamental
+//
+//	IK:
+//	  <- s
+//	  ...
+//	  -> e, es, s, ss
+//	  <- e, ee, se
+type Handshake struct {
+	initiator bool
+
+	local     PrivateKey
+	ephemeral PrivateKey
+	remote    PublicKey
+	remoteEph PublicKey
+
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+	k  []byte
+	n  uint64
+}
+
+// NewInitiator constructs the handshake of the peer that knows
+// the remote static key and starts the handshake
+func NewInitiator(local PrivateKey, remote PublicKey) *Handshake {
+	h := &Handshake{
+		initiator: true,
+		local:     local,
+		remote:    remote,
+	}
+
+	h.init()
+	h.mixHash(remote[:])
+
+	return h
+}
+
+// NewResponder constructs the handshake of the peer that
+// answers to an initiator
+func NewResponder(local PrivateKey) *Handshake {
+	h := &Handshake{
+		local: local,
+	}
+
+	h.init()
+	pub := local.Public()
+	h.mixHash(pub[:])
+
+	return h
+}
+
+// InitSize returns the size of the initiation message
+func InitSize(payloadLen int) int {
+	return 2*KeySize + 2*tagSize + payloadLen
+}
+
+// ResponseSize returns the size of the response message
+func ResponseSize(payloadLen int) int {
+	return KeySize + tagSize + payloadLen
+}
+
+// WriteInit creates the first message: e, es, s, ss
+func (h *Handshake) WriteInit(payload []byte) ([]byte, error) {
+	if !h.initiator {
+		return nil, errors.New("handshake: not initiator")
+	}
+
+	var err error
+
+	h.ephemeral, err = GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	e := h.ephemeral.Public()
+	msg := append([]byte{}, e[:]...)
+	h.mixHash(e[:])
+
+	if err := h.mixDH(h.ephemeral, h.remote); err != nil {
+		return nil, err
+	}
+
+	s := h.local.Public()
+	c, err := h.encryptAndHash(s[:])
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, c...)
+
+	if err := h.mixDH(h.local, h.remote); err != nil {
+		return nil, err
+	}
+
+	c, err = h.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(msg, c...), nil
+}
+
+// ReadInit consumes the first message and returns its payload,
+// the remote static key is available once it succeeded
+func (h *Handshake) ReadInit(msg []byte) ([]byte, error) {
+	if h.initiator {
+		return nil, errors.New("handshake: not responder")
+	}
+
+	if len(msg) < InitSize(0) {
+		return nil, errors.New("handshake: message is too short")
+	}
+
+	copy(h.remoteEph[:], msg[:KeySize])
+	h.mixHash(h.remoteEph[:])
+
+	if err := h.mixDH(h.local, h.remoteEph); err != nil {
+		return nil, err
+	}
+
+	s, err := h.decryptAndHash(msg[KeySize : 2*KeySize+tagSize])
+	if err != nil {
+		return nil, err
+	}
+	copy(h.remote[:], s)
+
+	if err := h.mixDH(h.local, h.remote); err != nil {
+		return nil, err
+	}
+
+	return h.decryptAndHash(msg[2*KeySize+tagSize:])
+}
+
+// WriteResponse creates the second message: e, ee, se
+func (h *Handshake) WriteResponse(payload []byte) ([]byte, error) {
+	if h.initiator {
+		return nil, errors.New("handshake: not responder")
+	}
+
+	var err error
+
+	h.ephemeral, err = GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	e := h.ephemeral.Public()
+	msg := append([]byte{}, e[:]...)
+	h.mixHash(e[:])
+
+	if err := h.mixDH(h.ephemeral, h.remoteEph); err != nil {
+		return nil, err
+	}
+
+	if err := h.mixDH(h.ephemeral, h.remote); err != nil {
+		return nil, err
+	}
+
+	c, err := h.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(msg, c...), nil
+}
+
+// ReadResponse consumes the second message and returns its payload
+func (h *Handshake) ReadResponse(msg []byte) ([]byte, error) {
+	if !h.initiator {
+		return nil, errors.New("handshake: not initiator")
+	}
+
+	if len(msg) < ResponseSize(0) {
+		return nil, errors.New("handshake: message is too short")
+	}
+
+	copy(h.remoteEph[:], msg[:KeySize])
+	h.mixHash(h.remoteEph[:])
+
+	if err := h.mixDH(h.ephemeral, h.remoteEph); err != nil {
+		return nil, err
+	}
+
+	if err := h.mixDH(h.local, h.remoteEph); err != nil {
+		return nil, err
+	}
+
+	return h.decryptAndHash(msg[KeySize:])
+}
+
+// RemoteStatic returns the static key of the remote peer
+func (h *Handshake) RemoteStatic() PublicKey {
+	return h.remote
+}
+
+// Split derives the transport keys for sending and receiving
+func (h *Handshake) Split() ([]byte, []byte, error) {
+	k1, k2, err := h.hkdf(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.initiator {
+		return k1, k2, nil
+	}
+
+	return k2, k1, nil
+}
+
+func (h *Handshake) init() {
+	copy(h.h[:], noiseProtocol)
+	h.ck = h.h
+	h.mixHash([]byte(noisePrologue))
+}
+
+func (h *Handshake) mixHash(data []byte) {
+	d := sha256.New()
+	d.Write(h.h[:])
+	d.Write(data)
+	d.Sum(h.h[:0])
+}
+
+func (h *Handshake) mixDH(k PrivateKey, p PublicKey) error {
+	shared, err := k.dh(p)
+	if err != nil {
+		return err
+	}
+
+	ck, key, err := h.hkdf(shared)
+	if err != nil {
+		return err
+	}
+
+	copy(h.ck[:], ck)
+	h.k = key
+	h.n = 0
+
+	return nil
+}
+
+func (h *Handshake) hkdf(ikm []byte) ([]byte, []byte, error) {
+	r := hkdf.New(sha256.New, ikm, h.ck[:], nil)
+	out := make([]byte, 2*sha256.Size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, nil, err
+	}
+
+	return out[:sha256.Size], out[sha256.Size:], nil
+}
+
+func (h *Handshake) aead() (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(h.k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:], h.n)
+	h.n++
+
+	return aead, nonce, nil
+}
+
+func (h *Handshake) encryptAndHash(plainData []byte) ([]byte, error) {
+	aead, nonce, err := h.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	cipherData := aead.Seal(nil, nonce, plainData, h.h[:])
+	h.mixHash(cipherData)
+
+	return cipherData, nil
+}
+
+func (h *Handshake) decryptAndHash(cipherData []byte) ([]byte, error) {
+	aead, nonce, err := h.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	plainData, err := aead.Open(nil, nonce, cipherData, h.h[:])
+	if err != nil {
+		return nil, err
+	}
+	h.mixHash(cipherData)
+
+	return plainData, nil
+}
@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	iKey, _ := GeneratePrivateKey()
+	rKey, _ := GeneratePrivateKey()
+
+	i := NewInitiator(iKey, rKey.Public())
+	r := NewResponder(rKey)
+
+	msg1, err := i.WriteInit([]byte("hello"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(msg1) != InitSize(5) {
+		t.Errorf("expected init size %d but got, %d", InitSize(5), len(msg1))
+	}
+
+	payload, err := r.ReadInit(msg1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if string(payload) != "hello" {
+		t.Error("expected hello but got,", string(payload))
+	}
+
+	if r.RemoteStatic() != iKey.Public() {
+		t.Error("expected initiator static key")
+	}
+
+	msg2, err := r.WriteResponse(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err := i.ReadResponse(msg2); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	iSend, iRecv, _ := i.Split()
+	rSend, rRecv, _ := r.Split()
+
+	if !bytes.Equal(iSend, rRecv) || !bytes.Equal(iRecv, rSend) {
+		t.Error("expected matched transport keys")
+	}
+
+	if bytes.Equal(iSend, iRecv) {
+		t.Error("expected different keys per direction")
+	}
+}
+
+func TestHandshakeWrongKey(t *testing.T) {
+	iKey, _ := GeneratePrivateKey()
+	rKey, _ := GeneratePrivateKey()
+	xKey, _ := GeneratePrivateKey()
+
+	i := NewInitiator(iKey, xKey.Public())
+	r := NewResponder(rKey)
+
+	msg1, _ := i.WriteInit(nil)
+	if _, err := r.ReadInit(msg1); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/crypto"
 	"github.com/mehrdadrad/radvpn/router"
 	"github.com/mehrdadrad/radvpn/server"
 )
@@ -15,6 +18,7 @@ import (
 var (
 	configFile string
 	update     string
+	genkey     string
 	etcd       bool
 	cfg        *config.Config
 )
@@ -22,6 +26,7 @@ var (
 func init() {
 	flag.StringVar(&configFile, "config", "", "configuration file")
 	flag.StringVar(&update, "update", "", "update etc / file")
+	flag.StringVar(&genkey, "genkey", "", "generate a private key file and print its public key")
 	flag.BoolVar(&etcd, "etcd", false, "enable etcd")
 	flag.Parse()
 }
@@ -38,8 +43,23 @@ func main() {
 		os.Exit(0)
 	}
 
+	if genkey != "" {
+		key, err := crypto.GeneratePrivateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = crypto.WritePrivateKeyFile(genkey, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(key.Public())
+		os.Exit(0)
+	}
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
 	if etcd {
 		cfg = config.New().FromEtcd(configFile)
@@ -52,12 +72,29 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// relay mode forwards the encrypted messages between the nodes
+	if flag.Arg(0) == "relay" {
+		token, err := cfg.GetRelayToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := server.NewRelayServer(cfg.Relay.Listen, token).Run(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}()
+
+		<-sig
+		return
+	}
+
 	notify := make(chan struct{}, 1)
 	cfg.Watcher(ctx, notify)
 
 	r := router.New(ctx)
 
-	s := server.Server{
+	s := &server.Server{
 		Config: cfg,
 		Router: r,
 		Notify: notify,
@@ -66,4 +103,9 @@ func main() {
 	s.Run(ctx)
 
 	<-sig
+
+	cancel()
+
+	// removes the nat rules and the kernel routes
+	s.Cleanup()
 }
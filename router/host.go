@@ -0,0 +1,528 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Protocol is the kernel route protocol number of the radvpn routes,
+// the routes can be listed by ip route show proto 87
+const Protocol = 87
+
+// Rule represents a policy routing rule which looks up the radvpn
+// routing table for the packets with the firewall mark or from the source
+type Rule struct {
+	Mark     int
+	Src      *net.IPNet
+	Priority int
+}
+
+// hostRoutes manages the kernel routes of the tunnel interface,
+// the policy routing rules and the underlay exclusions
+type hostRoutes interface {
+	list() ([]*net.IPNet, error)
+	add(networkid *net.IPNet) error
+	del(networkid *net.IPNet) error
+	addRule(rule Rule) error
+	delRule(rule Rule) error
+	addExclusion(ip net.IP) error
+	delExclusion(ip net.IP) error
+	purge() error
+}
+
+// netlinkRoutes manages the kernel routes by netlink, the routes
+// are installed at the table or the main table if it's zero
+type netlinkRoutes struct {
+	ifname string
+	table  int
+}
+
+func (n netlinkRoutes) route(networkid *net.IPNet) (*netlink.Route, error) {
+	ifce, err := netlink.LinkByName(n.ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.Route{
+		Dst:       networkid,
+		LinkIndex: ifce.Attrs().Index,
+		Protocol:  Protocol,
+		Table:     n.table,
+	}, nil
+}
+
+// list returns the routes of the interface which are tagged by the protocol
+func (n netlinkRoutes) list() ([]*net.IPNet, error) {
+	filter, err := n.route(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := netlink.RT_FILTER_OIF | netlink.RT_FILTER_PROTOCOL
+	if n.table != 0 {
+		mask |= netlink.RT_FILTER_TABLE
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	var networkids []*net.IPNet
+	defaults := make(map[string]bool)
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+
+		// the halves of a default route
+		if ones, _ := route.Dst.Mask.Size(); ones == 1 {
+			networkid := defaultRoute(route.Dst.IP)
+			if !defaults[networkid.String()] {
+				defaults[networkid.String()] = true
+				networkids = append(networkids, networkid)
+			}
+			continue
+		}
+
+		networkids = append(networkids, route.Dst)
+	}
+
+	return networkids, nil
+}
+
+func (n netlinkRoutes) add(networkid *net.IPNet) error {
+	for _, networkid := range halves(networkid) {
+		route, err := n.route(networkid)
+		if err != nil {
+			return err
+		}
+
+		if err := netlink.RouteAdd(route); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n netlinkRoutes) del(networkid *net.IPNet) error {
+	for _, networkid := range halves(networkid) {
+		route, err := n.route(networkid)
+		if err != nil {
+			return err
+		}
+
+		if err := netlink.RouteDel(route); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exclusion returns the host route of the ip through the underlay, it's
+// the longest prefix match of the main table apart from the tunnel
+func (n netlinkRoutes) exclusion(ip net.IP) (*netlink.Route, error) {
+	ifce, err := netlink.LinkByName(n.ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	family, bits := netlink.FAMILY_V6, 128
+	if ip.To4() != nil {
+		family, bits = netlink.FAMILY_V4, 32
+	}
+
+	routes, err := netlink.RouteListFiltered(family,
+		&netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		best  *netlink.Route
+		bestN = -1
+	)
+	for i, route := range routes {
+		if route.LinkIndex == ifce.Attrs().Index || route.Protocol == Protocol {
+			continue
+		}
+
+		ones := 0
+		if route.Dst != nil {
+			if !route.Dst.Contains(ip) {
+				continue
+			}
+			ones, _ = route.Dst.Mask.Size()
+		}
+
+		if ones > bestN {
+			best, bestN = &routes[i], ones
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no underlay route to %s", ip)
+	}
+
+	return &netlink.Route{
+		Dst:       &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Gw:        best.Gw,
+		LinkIndex: best.LinkIndex,
+		Protocol:  Protocol,
+		Table:     n.table,
+	}, nil
+}
+
+func (n netlinkRoutes) addExclusion(ip net.IP) error {
+	route, err := n.exclusion(ip)
+	if err != nil {
+		return err
+	}
+
+	return netlink.RouteAdd(route)
+}
+
+func (n netlinkRoutes) delExclusion(ip net.IP) error {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+
+	return netlink.RouteDel(&netlink.Route{
+		Dst:      &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Protocol: Protocol,
+		Table:    n.table,
+	})
+}
+
+// IsDefault reports whether the network id is a default route
+func IsDefault(networkid *net.IPNet) bool {
+	if networkid == nil {
+		return false
+	}
+
+	ones, _ := networkid.Mask.Size()
+	return ones == 0
+}
+
+// defaultRoute returns the default route of the ip address family
+func defaultRoute(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// halves returns the kernel routes of the network id, a default route
+// is installed as two halves so it overrides the host's default route
+// without replacing it
+func halves(networkid *net.IPNet) []*net.IPNet {
+	if !IsDefault(networkid) {
+		return []*net.IPNet{networkid}
+	}
+
+	_, bits := networkid.Mask.Size()
+	low := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+	high := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(1, bits)}
+	high.IP[0] = 0x80
+
+	return []*net.IPNet{low, high}
+}
+
+// purge removes the routes which are tagged by the protocol at all the
+// tables, e.g. the underlay exclusions and the routes of a previous table,
+// and the rules which look up the table or the tables of those routes
+func (n netlinkRoutes) purge() error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: Protocol},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+
+	tables := make(map[int]bool)
+	if n.table != 0 {
+		tables[n.table] = true
+	}
+
+	for i, route := range routes {
+		tables[route.Table] = true
+
+		if err := netlink.RouteDel(&routes[i]); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// the rules of the reserved tables are never removed
+	delete(tables, unix.RT_TABLE_MAIN)
+	delete(tables, unix.RT_TABLE_DEFAULT)
+	delete(tables, unix.RT_TABLE_LOCAL)
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return err
+		}
+
+		for i, rule := range rules {
+			if !tables[rule.Table] {
+				continue
+			}
+
+			rules[i].Family = family
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rules returns the netlink rules of the rule, a rule without
+// a source applies to both ipv4 and ipv6
+func (n netlinkRoutes) rules(rule Rule) []*netlink.Rule {
+	families := []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	if rule.Src != nil {
+		families = []int{netlink.FAMILY_V6}
+		if rule.Src.IP.To4() != nil {
+			families = []int{netlink.FAMILY_V4}
+		}
+	}
+
+	var rules []*netlink.Rule
+	for _, family := range families {
+		r := netlink.NewRule()
+		r.Family = family
+		r.Table = n.table
+		r.Src = rule.Src
+		if rule.Mark != 0 {
+			r.Mark = rule.Mark
+		}
+		if rule.Priority != 0 {
+			r.Priority = rule.Priority
+		}
+		rules = append(rules, r)
+	}
+
+	return rules
+}
+
+func (n netlinkRoutes) addRule(rule Rule) error {
+	for _, r := range n.rules(rule) {
+		if err := netlink.RuleAdd(r); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n netlinkRoutes) delRule(rule Rule) error {
+	for _, r := range n.rules(rule) {
+		if err := netlink.RuleDel(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hostRoutes returns the kernel routes manager
+func (r *Routes) hostRoutes() hostRoutes {
+	if r.host == nil {
+		return netlinkRoutes{ifname: "radvpn", table: r.policy.table}
+	}
+
+	return r.host
+}
+
+// SetTable sets the kernel routing table of the routes, it's set
+// before the cleanup so the stale routes of the table are removed
+func (r *Routes) SetTable(table int) {
+	r.Lock()
+	r.policy.table = table
+	r.Unlock()
+}
+
+// SetPolicy installs the routes at the kernel routing table and adds
+// the rules which look it up, the previous rules are removed. it should
+// be set before adding the routes
+func (r *Routes) SetPolicy(table int, rules []Rule) error {
+	if table == 0 && len(rules) > 0 {
+		return errors.New("policy rules need a routing table")
+	}
+
+	r.delRules()
+	r.SetTable(table)
+
+	host := r.hostRoutes()
+	for _, rule := range rules {
+		if err := host.addRule(rule); err != nil {
+			return err
+		}
+
+		r.Lock()
+		r.policy.rules = append(r.policy.rules, rule)
+		r.Unlock()
+	}
+
+	return nil
+}
+
+// delRules removes the installed policy rules
+func (r *Routes) delRules() {
+	r.Lock()
+	rules := r.policy.rules
+	r.policy.rules = nil
+	r.Unlock()
+
+	host := r.hostRoutes()
+	for _, rule := range rules {
+		if err := host.delRule(rule); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// SetUnderlay sets the addresses of the nodes, they're excluded from the
+// default routes through the tunnel so the tunnel doesn't loop into itself
+func (r *Routes) SetUnderlay(addrs []net.IP) {
+	r.Lock()
+	r.underlay.addrs = addrs
+	r.Unlock()
+
+	if r.hasDefault() {
+		r.exclude()
+	}
+}
+
+// hasDefault reports whether the table has a default route
+func (r *Routes) hasDefault() bool {
+	t := r.load()
+
+	return len(t.v4.exact(defaultRoute(net.IPv4zero))) > 0 ||
+		len(t.v6.exact(defaultRoute(net.IPv6zero))) > 0
+}
+
+// exclude installs the host routes of the underlay addresses
+// through the underlay and removes the old ones
+func (r *Routes) exclude() {
+	r.Lock()
+	defer r.Unlock()
+
+	host := r.hostRoutes()
+
+	if r.underlay.excluded == nil {
+		r.underlay.excluded = make(map[string]net.IP)
+	}
+
+	addrs := make(map[string]bool)
+	for _, ip := range r.underlay.addrs {
+		key := ip.String()
+		addrs[key] = true
+
+		if _, ok := r.underlay.excluded[key]; ok {
+			continue
+		}
+
+		if err := host.addExclusion(ip); err != nil && !errors.Is(err, os.ErrExist) {
+			log.Println(err)
+			continue
+		}
+
+		r.underlay.excluded[key] = ip
+	}
+
+	for key, ip := range r.underlay.excluded {
+		if addrs[key] {
+			continue
+		}
+
+		if err := host.delExclusion(ip); err != nil {
+			log.Println(err)
+		}
+
+		delete(r.underlay.excluded, key)
+	}
+}
+
+// include removes the host routes of the underlay addresses
+func (r *Routes) include() {
+	r.Lock()
+	defer r.Unlock()
+
+	host := r.hostRoutes()
+	for key, ip := range r.underlay.excluded {
+		if err := host.delExclusion(ip); err != nil {
+			log.Println(err)
+		}
+
+		delete(r.underlay.excluded, key)
+	}
+}
+
+// Reconcile installs the missing kernel routes of the table and
+// removes the stale kernel routes which are tagged by the protocol
+func (r *Routes) Reconcile() error {
+	host := r.hostRoutes()
+
+	if r.hasDefault() {
+		r.exclude()
+	}
+
+	want := make(map[string]*net.IPNet)
+	for _, route := range r.list() {
+		want[route.NetworkID.String()] = route.NetworkID
+	}
+
+	have, err := host.list()
+	if err != nil {
+		return err
+	}
+
+	installed := make(map[string]bool)
+	for _, networkid := range have {
+		installed[networkid.String()] = true
+
+		if _, ok := want[networkid.String()]; ok {
+			continue
+		}
+
+		log.Println("removing stale kernel route", networkid)
+		if err := host.del(networkid); err != nil {
+			log.Println(err)
+		}
+	}
+
+	for key, networkid := range want {
+		if installed[key] {
+			continue
+		}
+
+		// the connected routes of the interface already exist
+		if err := host.add(networkid); err != nil && !errors.Is(err, os.ErrExist) {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup removes the policy rules, the underlay exclusions and
+// all the kernel routes which are tagged by the protocol, including
+// the stale ones of a previous run at any table
+func (r *Routes) Cleanup() error {
+	r.delRules()
+	r.include()
+
+	return r.hostRoutes().purge()
+}
@@ -0,0 +1,208 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+)
+
+type testHost struct {
+	routes   map[string]*net.IPNet
+	rules    map[string]Rule
+	excluded map[string]bool
+}
+
+func newTestHost() *testHost {
+	return &testHost{
+		routes:   make(map[string]*net.IPNet),
+		rules:    make(map[string]Rule),
+		excluded: make(map[string]bool),
+	}
+}
+
+func (h *testHost) list() ([]*net.IPNet, error) {
+	var networkids []*net.IPNet
+	for _, networkid := range h.routes {
+		networkids = append(networkids, networkid)
+	}
+	return networkids, nil
+}
+
+func (h *testHost) add(networkid *net.IPNet) error {
+	h.routes[networkid.String()] = networkid
+	return nil
+}
+
+func (h *testHost) del(networkid *net.IPNet) error {
+	delete(h.routes, networkid.String())
+	return nil
+}
+
+func (h *testHost) addRule(rule Rule) error {
+	h.rules[fmt.Sprint(rule.Mark, rule.Src, rule.Priority)] = rule
+	return nil
+}
+
+func (h *testHost) delRule(rule Rule) error {
+	delete(h.rules, fmt.Sprint(rule.Mark, rule.Src, rule.Priority))
+	return nil
+}
+
+func (h *testHost) addExclusion(ip net.IP) error {
+	h.excluded[ip.String()] = true
+	return nil
+}
+
+func (h *testHost) delExclusion(ip net.IP) error {
+	delete(h.excluded, ip.String())
+	return nil
+}
+
+func (h *testHost) purge() error {
+	h.routes = make(map[string]*net.IPNet)
+	h.rules = make(map[string]Rule)
+	h.excluded = make(map[string]bool)
+	return nil
+}
+
+func (h *testHost) keys() []string {
+	var keys []string
+	for key := range h.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReconcile(t *testing.T) {
+	r := New(context.Background()).Table()
+	host := newTestHost()
+	r.host = host
+
+	_, stale, _ := net.ParseCIDR("10.0.9.0/24")
+	host.add(stale)
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	if err := r.Add(networkid, net.ParseIP("192.168.55.1")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// drift
+	_, missing, _ := net.ParseCIDR("10.0.4.0/24")
+	r.addToRouter(Route{NetworkID: missing, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}})
+
+	if err := r.Reconcile(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if keys := host.keys(); len(keys) != 2 || keys[0] != "10.0.3.0/24" || keys[1] != "10.0.4.0/24" {
+		t.Error("expected 10.0.3.0/24 and 10.0.4.0/24 but got,", keys)
+	}
+
+	// the stale exclusion and rule of a previous run
+	host.addExclusion(net.ParseIP("8.121.55.10"))
+	host.addRule(Rule{Mark: 100})
+
+	if err := r.Cleanup(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.routes) != 0 || len(host.excluded) != 0 || len(host.rules) != 0 {
+		t.Error("expected no kernel route, exclusion and rule but got,", host.keys(), host.excluded, host.rules)
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	r := New(context.Background()).Table()
+	host := newTestHost()
+	r.host = host
+
+	if err := r.SetPolicy(0, []Rule{{Mark: 1}}); err == nil {
+		t.Error("expected error for rules without table but got nil")
+	}
+
+	_, src, _ := net.ParseCIDR("172.17.0.0/16")
+	rules := []Rule{{Mark: 0x57, Priority: 100}, {Src: src}}
+	if err := r.SetPolicy(100, rules); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.rules) != 2 {
+		t.Error("expected 2 rules but got,", len(host.rules))
+	}
+
+	if err := r.SetPolicy(100, rules[:1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.rules) != 1 {
+		t.Error("expected 1 rule but got,", len(host.rules))
+	}
+
+	if err := r.Cleanup(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.rules) != 0 {
+		t.Error("expected no rule but got,", len(host.rules))
+	}
+}
+
+func TestExclusion(t *testing.T) {
+	r := New(context.Background()).Table()
+	host := newTestHost()
+	r.host = host
+
+	r.SetUnderlay([]net.IP{net.ParseIP("8.121.55.10"), net.ParseIP("8.121.55.11")})
+	if len(host.excluded) != 0 {
+		t.Error("expected no exclusion without default route but got,", host.excluded)
+	}
+
+	_, networkid, _ := net.ParseCIDR("0.0.0.0/0")
+	nexthop := net.ParseIP("192.168.55.10")
+	if err := r.Add(networkid, nexthop); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.excluded) != 2 {
+		t.Error("expected 2 exclusions but got,", host.excluded)
+	}
+
+	r.SetUnderlay([]net.IP{net.ParseIP("8.121.55.10")})
+	if len(host.excluded) != 1 || !host.excluded["8.121.55.10"] {
+		t.Error("expected 8.121.55.10 exclusion but got,", host.excluded)
+	}
+
+	if err := r.Delete(networkid, nexthop); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(host.excluded) != 0 {
+		t.Error("expected no exclusion but got,", host.excluded)
+	}
+}
+
+func TestHalves(t *testing.T) {
+	for _, prefix := range []string{"0.0.0.0/0", "::/0"} {
+		_, networkid, _ := net.ParseCIDR(prefix)
+		h := halves(networkid)
+		if len(h) != 2 {
+			t.Fatal("expected 2 halves but got,", h)
+		}
+
+		if ones, _ := h[0].Mask.Size(); ones != 1 || h[0].Contains(h[1].IP) {
+			t.Error("expected distinct /1 halves but got,", h)
+		}
+
+		if defaultRoute(h[1].IP).String() != networkid.String() {
+			t.Error("expected", networkid, "but got,", defaultRoute(h[1].IP))
+		}
+	}
+
+	_, networkid, _ := net.ParseCIDR("10.0.1.0/24")
+	if h := halves(networkid); len(h) != 1 || h[0] != networkid {
+		t.Error("expected the network id itself but got,", h)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"sync"
-
-	"github.com/vishvananda/netlink"
+	"sync/atomic"
 )
 
 // Gateway interfaces to router
@@ -14,9 +14,11 @@ type Gateway interface {
 	Table() *Routes
 }
 
-// NextHop represents nexthop / gateway
+// NextHop represents nexthop / gateway, the weight shares
+// the traffic between the nexthops of a network id
 type NextHop struct {
-	IP net.IP
+	IP     net.IP
+	Weight int
 }
 
 // Router represents router
@@ -30,125 +32,333 @@ func (r *Router) Table() *Routes {
 	return r.routes
 }
 
-// Route represents a route
+// Origin represents where a route comes from
+type Origin uint8
+
+const (
+	// OriginStatic is a route from the configuration
+	OriginStatic Origin = iota
+	// OriginLearned is a route advertised by a node at runtime
+	OriginLearned
+)
+
+func (o Origin) String() string {
+	switch o {
+	case OriginStatic:
+		return "static"
+	case OriginLearned:
+		return "learned"
+	}
+
+	return "unknown"
+}
+
+// Route represents a route, the lower metric is preferred
 type Route struct {
 	NextHop   NextHop
 	NetworkID *net.IPNet
+	Metric    int
+	Origin    Origin
 }
 
-// Routes represents array of routes
+// Routes represents the routing table, the routes are kept at
+// the longest prefix match tries per address family. the readers
+// load an immutable snapshot without locking and the writers
+// replace it by a modified copy (copy-on-write)
 type Routes struct {
+	// serializes the writers
 	sync.Mutex
 
-	table []Route
+	snapshot atomic.Value
+
+	// the kernel routes, it's netlink by default
+	host hostRoutes
+
+	policy struct {
+		table int
+		rules []Rule
+	}
+
+	// the node addresses and their installed exclusions
+	underlay struct {
+		addrs    []net.IP
+		excluded map[string]net.IP
+	}
+}
+
+// table represents an immutable snapshot of the routing table
+type table struct {
+	v4 trie
+	v6 trie
+
+	// the nexthops which are marked down by the 16 bytes ip
+	down map[string]bool
+}
+
+// trie returns the trie of the address family
+func (t *table) trie(ip net.IP) trie {
+	if ip.To4() != nil {
+		return t.v4
+	}
+
+	return t.v6
+}
+
+// with returns a copy of the table with the trie of the address family
+func (t *table) with(ip net.IP, tr trie) *table {
+	c := *t
+	if ip.To4() != nil {
+		c.v4 = tr
+	} else {
+		c.v6 = tr
+	}
+
+	return &c
+}
+
+// isUp reports whether the route's nexthop is not marked down
+func (t *table) isUp(route Route) bool {
+	return len(t.down) == 0 || !t.down[string(route.NextHop.IP.To16())]
 }
 
-func (r *Routes) addToRouter(networkid *net.IPNet, nexthop net.IP) error {
-	for _, route := range r.table {
-		if nexthop.Equal(route.NextHop.IP) && networkid.String() == route.NetworkID.String() {
-			return fmt.Errorf("route exist %s %s", networkid, nexthop)
+// best returns the up routes with the lowest metric of the longest
+// prefix which contains the dest., a prefix without any up route
+// fails over to the shorter prefixes
+func (t *table) best(dst net.IP) []Route {
+	tr := t.trie(dst)
+	if dst.To4() != nil {
+		dst = dst.To4()
+	}
+
+	routes := tr.lookup(dst, t.isUp)
+	if len(routes) == 0 {
+		return nil
+	}
+
+	metric := routes[0].Metric
+	for _, route := range routes {
+		if route.Metric < metric {
+			metric = route.Metric
+		}
+	}
+
+	best := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		if route.Metric == metric {
+			best = append(best, route)
 		}
 	}
 
+	return best
+}
+
+// load returns the current snapshot
+func (r *Routes) load() *table {
+	t, ok := r.snapshot.Load().(*table)
+	if !ok {
+		return &table{}
+	}
+
+	return t
+}
+
+func (r *Routes) addToRouter(route Route) error {
 	r.Lock()
+	defer r.Unlock()
 
-	r.table = append(r.table, Route{
-		NextHop:   NextHop{IP: nexthop},
-		NetworkID: networkid,
-	})
+	if route.NextHop.Weight < 1 {
+		route.NextHop.Weight = 1
+	}
 
-	r.Unlock()
+	t := r.load()
+	tr, ok := t.trie(route.NetworkID.IP).insert(route)
+	if !ok {
+		return fmt.Errorf("route exist %s %s: %w", route.NetworkID, route.NextHop.IP, os.ErrExist)
+	}
+
+	r.snapshot.Store(t.with(route.NetworkID.IP, tr))
 
 	return nil
 }
 
 func (r *Routes) addToHost(networkid *net.IPNet, nexthop net.IP) error {
-	ifce, err := netlink.LinkByName("radvpn")
-	if err != nil {
-		return err
+	// the underlay should be excluded before the default route
+	if IsDefault(networkid) {
+		r.exclude()
 	}
 
-	route := &netlink.Route{
-		Dst:       networkid,
-		LinkIndex: ifce.Attrs().Index,
-	}
-	return netlink.RouteAdd(route)
+	return r.hostRoutes().add(networkid)
 }
 
 // Add appends a new route to table and operating system
 func (r *Routes) Add(networkid *net.IPNet, nexthop net.IP) error {
-	err := r.addToRouter(networkid, nexthop)
+	return r.AddRoute(Route{
+		NextHop:   NextHop{IP: nexthop, Weight: 1},
+		NetworkID: networkid,
+	})
+}
+
+// AddRoute appends a new route to table and operating system, an
+// existing nexthop of the network id updates by the new weight and metric
+func (r *Routes) AddRoute(route Route) error {
+	err := r.addToRouter(route)
 	if err != nil {
 		return err
 	}
 
-	return r.addToHost(networkid, nexthop)
+	// the host route already exists by the other nexthops
+	if len(r.load().trie(route.NetworkID.IP).exact(route.NetworkID)) > 1 {
+		return nil
+	}
+
+	return r.addToHost(route.NetworkID, route.NextHop.IP)
 }
 
-func (r *Routes) delFromRouter(networkid *net.IPNet, nexthop net.IP) error {
-	var routeRemoved bool
+// SetDown marks the nexthop down or up, the routes through a down
+// nexthop are skipped and the traffic fails over to the next-best route
+func (r *Routes) SetDown(nexthop net.IP, down bool) {
+	r.Lock()
+	defer r.Unlock()
 
-	for k, v := range r.table {
-		if v.NetworkID.String() == networkid.String() && nexthop.Equal(v.NextHop.IP) {
-			r.Lock()
+	key := string(nexthop.To16())
 
-			r.table[k] = r.table[len(r.table)-1]
-			r.table = r.table[:len(r.table)-1]
+	t := r.load()
+	if t.down[key] == down {
+		return
+	}
 
-			r.Unlock()
-			routeRemoved = true
-			break
-		}
+	c := *t
+	c.down = make(map[string]bool, len(t.down)+1)
+	for k, v := range t.down {
+		c.down[k] = v
 	}
 
-	if !routeRemoved {
-		return fmt.Errorf("can not delete route, not found %s", networkid.String())
+	if down {
+		c.down[key] = true
+	} else {
+		delete(c.down, key)
 	}
 
+	r.snapshot.Store(&c)
+}
+
+// IsDown reports whether the nexthop is marked down
+func (r *Routes) IsDown(nexthop net.IP) bool {
+	return r.load().down[string(nexthop.To16())]
+}
+
+func (r *Routes) delFromRouter(route Route) error {
+	r.Lock()
+	defer r.Unlock()
+
+	t := r.load()
+	tr, ok := t.trie(route.NetworkID.IP).remove(route)
+	if !ok {
+		return fmt.Errorf("can not delete route, not found %s", route.NetworkID.String())
+	}
+
+	r.snapshot.Store(t.with(route.NetworkID.IP, tr))
+
 	return nil
 }
 
 func (r *Routes) delFromHost(networkid *net.IPNet, nexthop net.IP) error {
-	ifce, err := netlink.LinkByName("radvpn")
-	if err != nil {
-		return err
-	}
+	err := r.hostRoutes().del(networkid)
 
-	route := &netlink.Route{
-		Dst:       networkid,
-		LinkIndex: ifce.Attrs().Index,
+	if IsDefault(networkid) && !r.hasDefault() {
+		r.include()
 	}
 
-	return netlink.RouteDel(route)
+	return err
 }
 
-// Delete removes a route from table and operating system
+// Delete removes a static route from table and operating system
 func (r *Routes) Delete(networkid *net.IPNet, nexthop net.IP) error {
+	return r.DeleteRoute(Route{
+		NextHop:   NextHop{IP: nexthop},
+		NetworkID: networkid,
+	})
+}
 
-	err := r.delFromRouter(networkid, nexthop)
+// DeleteRoute removes the route of the network id, the nexthop
+// and the origin from table and operating system
+func (r *Routes) DeleteRoute(route Route) error {
+	err := r.delFromRouter(route)
 	if err != nil {
 		return err
 	}
 
-	return r.delFromHost(networkid, nexthop)
+	// the other nexthops still use the host route
+	if len(r.load().trie(route.NetworkID.IP).exact(route.NetworkID)) > 0 {
+		return nil
+	}
+
+	return r.delFromHost(route.NetworkID, route.NextHop.IP)
 }
 
-// Get returns nexthop for a specific dest.
+// Get returns nexthop for a specific dest. based on
+// the longest prefix match and the metric, it doesn't
+// block by the writers
 func (r *Routes) Get(dst net.IP) net.IP {
-	for _, route := range r.table {
-		if route.NetworkID.Contains(dst) {
+	routes := r.load().best(dst)
+	if len(routes) == 0 {
+		return nil
+	}
+
+	return routes[0].NextHop.IP
+}
+
+// GetByHash returns one of the nexthops for a specific dest.
+// based on the flow hash and the nexthops weight, the same
+// hash always gets the same nexthop (equal-cost multi-path)
+func (r *Routes) GetByHash(dst net.IP, hash uint32) net.IP {
+	routes := r.load().best(dst)
+	if len(routes) == 0 {
+		return nil
+	}
+
+	var total uint32
+	for _, route := range routes {
+		total += uint32(route.NextHop.Weight)
+	}
+
+	n := hash % total
+	for _, route := range routes {
+		w := uint32(route.NextHop.Weight)
+		if n < w {
 			return route.NextHop.IP
 		}
+		n -= w
 	}
 
-	return nil
+	return routes[0].NextHop.IP
+}
+
+// list returns all the routes
+func (r *Routes) list() []Route {
+	var routes []Route
+
+	t := r.load()
+	for _, t := range []trie{t.v4, t.v6} {
+		t.walk(func(route Route) {
+			routes = append(routes, route)
+		})
+	}
+
+	return routes
 }
 
 // Dump prints out all routing table
 func (r *Routes) Dump() {
-	fmt.Println("networkid\tnexthop")
-	for _, route := range r.table {
-		fmt.Println(route.NetworkID, route.NextHop.IP)
+	t := r.load()
+
+	fmt.Println("networkid\tnexthop\tweight\tmetric\torigin\tstate")
+	for _, route := range r.list() {
+		state := "up"
+		if !t.isUp(route) {
+			state = "down"
+		}
+		fmt.Println(route.NetworkID, route.NextHop.IP, route.NextHop.Weight, route.Metric, route.Origin, state)
 	}
 }
 
@@ -15,15 +15,16 @@ func TestAddFromRouter(t *testing.T) {
 	_, subnet, _ := net.ParseCIDR(subnetStr)
 	nexthop := net.ParseIP(nexthopStr)
 
-	r.addToRouter(subnet, nexthop)
+	r.addToRouter(Route{NetworkID: subnet, NextHop: NextHop{IP: nexthop}})
 
-	if len(r.table) == 1 {
-		if r.table[0].NextHop.IP.String() != nexthopStr {
-			t.Errorf("expect nexthop %s but got, %s", nexthopStr, r.table[0].NextHop.IP.String())
+	routes := r.list()
+	if len(routes) == 1 {
+		if routes[0].NextHop.IP.String() != nexthopStr {
+			t.Errorf("expect nexthop %s but got, %s", nexthopStr, routes[0].NextHop.IP.String())
 		}
 
-		if r.table[0].NetworkID.String() != subnetStr {
-			t.Errorf("expect networkid %s but got, %s", subnetStr, r.table[0].NetworkID.String())
+		if routes[0].NetworkID.String() != subnetStr {
+			t.Errorf("expect networkid %s but got, %s", subnetStr, routes[0].NetworkID.String())
 		}
 	} else {
 		t.Error("route.add method can't add a route")
@@ -39,15 +40,15 @@ func TestDelFromRouter(t *testing.T) {
 	_, subnet, _ := net.ParseCIDR(subnetStr)
 	nexthop := net.ParseIP(nexthopStr)
 
-	r.addToRouter(subnet, nexthop)
+	r.addToRouter(Route{NetworkID: subnet, NextHop: NextHop{IP: nexthop}})
 
-	if len(r.table) == 1 {
-		err := r.delFromRouter(subnet, nexthop)
+	if len(r.list()) == 1 {
+		err := r.delFromRouter(Route{NetworkID: subnet, NextHop: NextHop{IP: nexthop}})
 		if err != nil {
 			t.Error("unexpected error happened:", err)
 		}
 
-		if len(r.table) != 0 {
+		if len(r.list()) != 0 {
 			t.Error("route.del method can't del a route")
 		}
 	}
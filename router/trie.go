@@ -0,0 +1,201 @@
+package router
+
+import "net"
+
+// trie represents a binary radix trie of the network ids,
+// it looks up the longest prefix match in O(address bits).
+// the trie is immutable, the updates copy the nodes on the
+// path of the network id and return a new trie
+type trie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	routes   []Route
+}
+
+// clone returns a copy of the node, a nil node is cloned to an empty one
+func (n *trieNode) clone() *trieNode {
+	if n == nil {
+		return new(trieNode)
+	}
+
+	c := *n
+
+	return &c
+}
+
+// insert returns a new trie with the route, an existing nexthop of
+// the origin is replaced by the new weight and metric, it returns
+// false if the route already exists
+func (t trie) insert(route Route) (trie, bool) {
+	ip, ones := prefix(route.NetworkID)
+
+	size := t.size + 1
+	k := -1
+	for i, r := range t.exact(route.NetworkID) {
+		if r.Origin == route.Origin && r.NextHop.IP.Equal(route.NextHop.IP) {
+			if r.NextHop.Weight == route.NextHop.Weight && r.Metric == route.Metric {
+				return t, false
+			}
+			size, k = t.size, i
+			break
+		}
+	}
+
+	root := t.root.clone()
+
+	n := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		n.children[b] = n.children[b].clone()
+		n = n.children[b]
+	}
+
+	var routes []Route
+	if k < 0 {
+		// the full slice expression forces a new backing array
+		routes = append(n.routes[:len(n.routes):len(n.routes)], route)
+	} else {
+		routes = append([]Route(nil), n.routes...)
+		routes[k] = route
+	}
+	n.routes = routes
+
+	return trie{root: root, size: size}, true
+}
+
+// remove returns a new trie without the route of the network id, the
+// nexthop and the origin and prunes the empty nodes, it returns false
+// if not found
+func (t trie) remove(route Route) (trie, bool) {
+	networkid := route.NetworkID
+
+	k := -1
+	for i, r := range t.exact(networkid) {
+		if r.Origin == route.Origin && r.NextHop.IP.Equal(route.NextHop.IP) {
+			k = i
+			break
+		}
+	}
+
+	if k < 0 {
+		return t, false
+	}
+
+	ip, ones := prefix(networkid)
+
+	path := make([]*trieNode, 0, ones+1)
+	n := t.root.clone()
+	for i := 0; i < ones; i++ {
+		path = append(path, n)
+		b := bit(ip, i)
+		n.children[b] = n.children[b].clone()
+		n = n.children[b]
+	}
+
+	n.routes = append(n.routes[:k:k], n.routes[k+1:]...)
+
+	// prune the empty leaves up to the root
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(n.routes) > 0 || n.children[0] != nil || n.children[1] != nil {
+			break
+		}
+		path[i].children[bit(ip, i)] = nil
+		n = path[i]
+	}
+
+	root := n
+	if len(path) > 0 {
+		root = path[0]
+	}
+
+	return trie{root: root, size: t.size - 1}, true
+}
+
+// lookup returns the accepted routes of the longest prefix which
+// contains the ip and has at least one accepted route
+func (t trie) lookup(ip net.IP, accept func(Route) bool) []Route {
+	var best *trieNode
+
+	n := t.root
+	for i := 0; n != nil; i++ {
+		for _, r := range n.routes {
+			if accept(r) {
+				best = n
+				break
+			}
+		}
+
+		if i == len(ip)*8 {
+			break
+		}
+
+		n = n.children[bit(ip, i)]
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	routes := make([]Route, 0, len(best.routes))
+	for _, r := range best.routes {
+		if accept(r) {
+			routes = append(routes, r)
+		}
+	}
+
+	return routes
+}
+
+// exact returns the routes of the network id
+func (t trie) exact(networkid *net.IPNet) []Route {
+	ip, ones := prefix(networkid)
+
+	n := t.root
+	for i := 0; i < ones && n != nil; i++ {
+		n = n.children[bit(ip, i)]
+	}
+
+	if n == nil {
+		return nil
+	}
+
+	return n.routes
+}
+
+// walk calls the function for all the routes
+func (t trie) walk(fn func(Route)) {
+	var walk func(*trieNode)
+
+	walk = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+
+		for _, r := range n.routes {
+			fn(r)
+		}
+
+		walk(n.children[0])
+		walk(n.children[1])
+	}
+
+	walk(t.root)
+}
+
+// prefix returns the network ip at its family length and the prefix length
+func prefix(networkid *net.IPNet) (net.IP, int) {
+	ones, bits := networkid.Mask.Size()
+	if bits == 8*net.IPv4len {
+		return networkid.IP.To4(), ones
+	}
+
+	return networkid.IP.To16(), ones
+}
+
+func bit(ip net.IP, i int) byte {
+	return (ip[i/8] >> (7 - uint(i%8))) & 1
+}
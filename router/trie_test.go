@@ -0,0 +1,250 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestGetLongestPrefix(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	for subnet, nexthop := range map[string]string{
+		"10.0.0.0/8":      "192.168.55.1",
+		"10.0.3.0/24":     "192.168.55.2",
+		"0.0.0.0/0":       "192.168.55.3",
+		"2001:db8::/32":   "2001:db8:ffff::1",
+		"2001:db8:1::/48": "2001:db8:ffff::2",
+	} {
+		_, networkid, _ := net.ParseCIDR(subnet)
+		if err := r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP(nexthop)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for dst, expected := range map[string]string{
+		"10.0.3.5":      "192.168.55.2",
+		"10.0.4.5":      "192.168.55.1",
+		"172.16.1.1":    "192.168.55.3",
+		"2001:db8:1::5": "2001:db8:ffff::2",
+		"2001:db8:2::5": "2001:db8:ffff::1",
+	} {
+		nexthop := r.Get(net.ParseIP(dst))
+		if nexthop.String() != expected {
+			t.Errorf("%s: expected %s but got, %s", dst, expected, nexthop)
+		}
+	}
+
+	if nexthop := r.Get(net.ParseIP("2001:db9::1")); nexthop != nil {
+		t.Error("expected nil but got,", nexthop)
+	}
+}
+
+func TestTrieRemove(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	nexthop := net.ParseIP("192.168.55.1")
+
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: nexthop}})
+
+	if err := r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: nexthop}}); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	if err := r.delFromRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: nexthop}}); err != nil {
+		t.Error("unexpected error happened:", err)
+	}
+
+	if v4 := r.load().v4; v4.root.children[0] != nil || v4.size != 0 {
+		t.Error("expected pruned trie but got,", v4.size)
+	}
+
+	if err := r.delFromRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: nexthop}}); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func benchmarkRoutes(n int) *Routes {
+	r := &Routes{}
+
+	for i := 0; i < n; i++ {
+		_, networkid, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}})
+
+		_, networkid, _ = net.ParseCIDR(fmt.Sprintf("2001:db8:%x::/48", i))
+		r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("2001:db8:ffff::1")}})
+	}
+
+	return r
+}
+
+func BenchmarkGetIPv4(b *testing.B) {
+	r := benchmarkRoutes(10000)
+	dst := net.ParseIP("10.39.15.1")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Get(dst)
+	}
+}
+
+func BenchmarkGetIPv6(b *testing.B) {
+	r := benchmarkRoutes(10000)
+	dst := net.ParseIP("2001:db8:270f::1")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Get(dst)
+	}
+}
+
+func TestConcurrentGet(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.0.0/8")
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_, subnet, _ := net.ParseCIDR(fmt.Sprintf("10.0.%d.0/24", i%256))
+			r.addToRouter(Route{NetworkID: subnet, NextHop: NextHop{IP: net.ParseIP("192.168.55.2")}})
+			r.delFromRouter(Route{NetworkID: subnet, NextHop: NextHop{IP: net.ParseIP("192.168.55.2")}})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if nexthop := r.Get(net.ParseIP("10.0.1.1")); nexthop == nil {
+			t.Fatal("expected nexthop but got nil")
+		}
+	}
+}
+
+func TestSnapshotImmutable(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}})
+
+	snapshot := r.load()
+
+	r.delFromRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}})
+
+	if snapshot.best(net.ParseIP("10.0.3.1")) == nil {
+		t.Error("the snapshot changed by the writer")
+	}
+
+	if r.Get(net.ParseIP("10.0.3.1")) != nil {
+		t.Error("expected nil but got a nexthop")
+	}
+}
+
+func TestGetByHash(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1"), Weight: 1}})
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.2"), Weight: 3}})
+
+	dst := net.ParseIP("10.0.3.1")
+	counts := map[string]int{}
+	for hash := uint32(0); hash < 400; hash++ {
+		nexthop := r.GetByHash(dst, hash)
+		counts[nexthop.String()]++
+
+		if !nexthop.Equal(r.GetByHash(dst, hash)) {
+			t.Error("expected the same nexthop for the same hash")
+		}
+	}
+
+	if counts["192.168.55.1"] != 100 || counts["192.168.55.2"] != 300 {
+		t.Error("expected 100/300 weighted nexthops but got,", counts)
+	}
+
+	// update the weight
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.2"), Weight: 1}})
+	if routes := r.list(); len(routes) != 2 || routes[1].NextHop.Weight != 1 {
+		t.Error("expected the updated weight but got,", routes)
+	}
+
+	if nexthop := r.GetByHash(net.ParseIP("10.0.4.1"), 1); nexthop != nil {
+		t.Error("expected nil but got,", nexthop)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	_, fallback, _ := net.ParseCIDR("10.0.0.0/8")
+
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.1")}, Metric: 10})
+	r.addToRouter(Route{NetworkID: networkid, NextHop: NextHop{IP: net.ParseIP("192.168.55.2")}, Metric: 20})
+	r.addToRouter(Route{NetworkID: fallback, NextHop: NextHop{IP: net.ParseIP("192.168.55.3")}})
+
+	dst := net.ParseIP("10.0.3.1")
+
+	for _, c := range []struct {
+		down     string
+		expected string
+	}{
+		{"", "192.168.55.1"},
+		{"192.168.55.1", "192.168.55.2"},
+		{"192.168.55.2", "192.168.55.3"},
+		{"192.168.55.3", "<nil>"},
+	} {
+		if c.down != "" {
+			r.SetDown(net.ParseIP(c.down), true)
+		}
+
+		if nexthop := r.Get(dst); nexthop.String() != c.expected {
+			t.Errorf("expected %s but got, %s", c.expected, nexthop)
+		}
+
+		if nexthop := r.GetByHash(dst, 7); nexthop.String() != c.expected {
+			t.Errorf("expected %s but got, %s", c.expected, nexthop)
+		}
+	}
+
+	r.SetDown(net.ParseIP("192.168.55.1"), false)
+	if nexthop := r.Get(dst); nexthop.String() != "192.168.55.1" {
+		t.Error("expected 192.168.55.1 but got,", nexthop)
+	}
+
+	if !r.IsDown(net.ParseIP("192.168.55.2")) || r.IsDown(net.ParseIP("192.168.55.1")) {
+		t.Error("unexpected nexthop state")
+	}
+}
+
+func TestRouteOrigin(t *testing.T) {
+	r := New(context.Background()).Table()
+
+	_, networkid, _ := net.ParseCIDR("10.0.3.0/24")
+	nexthop := NextHop{IP: net.ParseIP("192.168.55.1")}
+
+	r.addToRouter(Route{NetworkID: networkid, NextHop: nexthop})
+	if err := r.addToRouter(Route{NetworkID: networkid, NextHop: nexthop, Origin: OriginLearned}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if routes := r.list(); len(routes) != 2 {
+		t.Fatal("expected static and learned routes but got,", routes)
+	}
+
+	if err := r.delFromRouter(Route{NetworkID: networkid, NextHop: nexthop, Origin: OriginLearned}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if routes := r.list(); len(routes) != 1 || routes[0].Origin != OriginStatic {
+		t.Error("expected the static route but got,", routes)
+	}
+}
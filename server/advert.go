@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+// maxAdvertSize is the max size of a route advertisement payload,
+// the larger advertisements are split into several messages
+const maxAdvertSize = 1024
+
+// route advertisement layout, the type is followed by the entries
+//
+//	+--------+--------+--------+--------+
+//	|  type  |prefix  | ip len |  ip    |
+//	+--------+--------+--------+        +
+//	|  ip (4 or 16 bytes)      | weight |
+//	+--------+--------+--------+--------+
+//	| weight |          metric          |
+//	+--------+--------+--------+--------+
+//	| metric |  next entry ...
+//	+--------+
+//
+// the advertised routes are refreshed every advertise interval and the
+// learned routes expire once they haven't been refreshed for 3 intervals
+const advertEntrySize = 1 + 1 + 2 + 4
+
+// adverts holds the local advertised subnets and the learned routes
+type adverts struct {
+	sync.Mutex
+
+	local   map[string]config.Subnet
+	learned map[string]learnedRoute
+	changes chan advertChange
+}
+
+// learnedRoute represents a route advertised by a node
+type learnedRoute struct {
+	route   router.Route
+	expires time.Time
+}
+
+type advertChange struct {
+	subnet   config.Subnet
+	withdraw bool
+}
+
+func newAdverts() *adverts {
+	return &adverts{
+		local:   make(map[string]config.Subnet),
+		learned: make(map[string]learnedRoute),
+		changes: make(chan advertChange, maxChanSize),
+	}
+}
+
+// Advertise advertises the subnet to the nodes at runtime
+func (s *Server) Advertise(subnet config.Subnet) error {
+	_, dst, err := net.ParseCIDR(subnet.Prefix)
+	if err != nil {
+		return err
+	}
+
+	subnet.Prefix = dst.String()
+
+	s.adverts.Lock()
+	s.adverts.local[subnet.Prefix] = subnet
+	s.adverts.Unlock()
+
+	s.adverts.notify(advertChange{subnet: subnet})
+
+	return nil
+}
+
+// Withdraw withdraws the advertised subnet from the nodes
+func (s *Server) Withdraw(prefix string) error {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	s.adverts.Lock()
+	subnet, ok := s.adverts.local[dst.String()]
+	delete(s.adverts.local, dst.String())
+	s.adverts.Unlock()
+
+	if !ok {
+		return fmt.Errorf("subnet %s is not advertised", prefix)
+	}
+
+	s.adverts.notify(advertChange{subnet: subnet, withdraw: true})
+
+	return nil
+}
+
+// notify queues the change for the advertiser, a dropped advertisement
+// is sent by the next refresh and a dropped withdrawal expires
+func (a *adverts) notify(c advertChange) {
+	select {
+	case a.changes <- c:
+	default:
+		log.Println("route advertisement queue is full")
+	}
+}
+
+// advertised returns the local advertised subnets sorted by prefix
+func (a *adverts) advertised() []config.Subnet {
+	a.Lock()
+	defer a.Unlock()
+
+	subnets := make([]config.Subnet, 0, len(a.local))
+	for _, subnet := range a.local {
+		subnets = append(subnets, subnet)
+	}
+
+	sort.Slice(subnets, func(i, j int) bool {
+		return subnets[i].Prefix < subnets[j].Prefix
+	})
+
+	return subnets
+}
+
+// advertiser sends the changes immediately and refreshes the
+// advertised subnets every advertise interval
+func (s *Server) advertiser(ctx context.Context, conn net.PacketConn) {
+	ticker := time.NewTicker(s.advertiseInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-s.adverts.changes:
+			typ := ctrlRouteAdvertise
+			if c.withdraw {
+				typ = ctrlRouteWithdraw
+			}
+			s.sendAdverts(conn, typ, []config.Subnet{c.subnet})
+		case <-ticker.C:
+			s.sendAdverts(conn, ctrlRouteAdvertise, s.adverts.advertised())
+			s.expireLearned()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advertiseInterval returns the refresh interval of the advertisements
+func (s *Server) advertiseInterval() time.Duration {
+	interval := time.Duration(s.Config.Routing.AdvertiseInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return interval
+}
+
+// sendAdverts sends the subnets to the peers which are reached directly
+func (s *Server) sendAdverts(conn net.PacketConn, typ byte, subnets []config.Subnet) {
+	if len(subnets) == 0 {
+		return
+	}
+
+	for _, msg := range marshalAdverts(typ, subnets) {
+		for _, p := range s.directPeers() {
+			b, err := s.seal(conn, p, msg)
+			if err != nil {
+				if err != errNoSession {
+					log.Println(err)
+				}
+				continue
+			}
+
+			if _, err := conn.WriteTo(b, p.endpoint()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// learn updates the learned routes by the advertisement from the peer
+func (s *Server) learn(p *peer, b []byte) error {
+	if !s.Config.Routing.Learn || s.Router == nil {
+		return nil
+	}
+
+	subnets, err := unmarshalAdverts(b[1:])
+	if err != nil {
+		return err
+	}
+
+	node := p.getNode()
+	expires := time.Now().Add(3 * s.advertiseInterval())
+
+	for _, subnet := range subnets {
+		_, dst, _ := net.ParseCIDR(subnet.Prefix)
+		if !s.accepted(dst) {
+			log.Printf("node %s: advertised subnet %s is not accepted", node.Name, dst)
+			continue
+		}
+
+		route := router.Route{
+			NextHop: router.NextHop{
+				IP:     net.ParseIP(node.Address),
+				Weight: subnet.GetWeight(),
+			},
+			NetworkID: dst,
+			Metric:    subnet.Metric,
+			Origin:    router.OriginLearned,
+		}
+
+		key := node.Address + " " + dst.String()
+
+		if b[0] == ctrlRouteWithdraw {
+			s.adverts.Lock()
+			_, ok := s.adverts.learned[key]
+			delete(s.adverts.learned, key)
+			s.adverts.Unlock()
+
+			if ok {
+				if err := s.Router.Table().DeleteRoute(route); err != nil {
+					log.Println(err)
+				}
+			}
+			continue
+		}
+
+		s.adverts.Lock()
+		s.adverts.learned[key] = learnedRoute{route: route, expires: expires}
+		s.adverts.Unlock()
+
+		err := s.Router.Table().AddRoute(route)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// expireLearned removes the learned routes which haven't been refreshed
+func (s *Server) expireLearned() {
+	var expired []router.Route
+
+	now := time.Now()
+
+	s.adverts.Lock()
+	for key, learned := range s.adverts.learned {
+		if now.After(learned.expires) {
+			expired = append(expired, learned.route)
+			delete(s.adverts.learned, key)
+		}
+	}
+	s.adverts.Unlock()
+
+	for _, route := range expired {
+		if err := s.Router.Table().DeleteRoute(route); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// accepted reports whether the learned subnet is within the accepted
+// prefixes, all the subnets except the default routes are accepted if
+// there is no accepted prefix. a default route is only accepted explicitly
+func (s *Server) accepted(dst *net.IPNet) bool {
+	if !router.IsDefault(dst) && s.coversUnderlay(dst) {
+		return false
+	}
+
+	if len(s.Config.Routing.Accept) == 0 {
+		return !router.IsDefault(dst)
+	}
+
+	ones, _ := dst.Mask.Size()
+	for _, prefix := range s.Config.Routing.Accept {
+		_, accept, err := net.ParseCIDR(prefix)
+		if err != nil {
+			continue
+		}
+
+		acceptOnes, _ := accept.Mask.Size()
+		if accept.Contains(dst.IP) && acceptOnes <= ones && len(accept.IP) == len(dst.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coversUnderlay reports whether the prefix contains an endpoint of the
+// nodes or the relay server, the tunnel packets would loop into the
+// tunnel by its route. the default routes are excluded by the underlay
+func (s *Server) coversUnderlay(dst *net.IPNet) bool {
+	var ips []net.IP
+	for _, nodes := range s.Config.Nodes {
+		for _, e := range nodes.Node.GetEndpoints() {
+			if ip := net.ParseIP(e.Address); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	if s.peers != nil {
+		for _, p := range s.peers.all() {
+			ips = append(ips, p.endpointIPs()...)
+		}
+	}
+
+	if s.relayServer != nil {
+		ips = append(ips, s.relayServer.IP)
+	}
+
+	for _, ip := range ips {
+		if dst.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// marshalAdverts encodes the subnets to one or more messages
+func marshalAdverts(typ byte, subnets []config.Subnet) [][]byte {
+	var msgs [][]byte
+
+	b := []byte{typ}
+	for _, subnet := range subnets {
+		_, dst, err := net.ParseCIDR(subnet.Prefix)
+		if err != nil {
+			continue
+		}
+
+		ip := dst.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ones, _ := dst.Mask.Size()
+
+		if len(b)+advertEntrySize+len(ip) > maxAdvertSize {
+			msgs = append(msgs, b)
+			b = []byte{typ}
+		}
+
+		entry := make([]byte, advertEntrySize+len(ip))
+		entry[0] = byte(ones)
+		entry[1] = byte(len(ip))
+		copy(entry[2:], ip)
+		binary.BigEndian.PutUint16(entry[2+len(ip):], uint16(subnet.Weight))
+		binary.BigEndian.PutUint32(entry[4+len(ip):], uint32(subnet.Metric))
+
+		b = append(b, entry...)
+	}
+
+	if len(b) > 1 {
+		msgs = append(msgs, b)
+	}
+
+	return msgs
+}
+
+// unmarshalAdverts decodes the entries of an advertisement
+func unmarshalAdverts(b []byte) ([]config.Subnet, error) {
+	var subnets []config.Subnet
+
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errShortPacket
+		}
+
+		ones, ipLen := int(b[0]), int(b[1])
+		if ipLen != net.IPv4len && ipLen != net.IPv6len || ones > ipLen*8 {
+			return nil, errors.New("invalid route advertisement")
+		}
+
+		if len(b) < advertEntrySize+ipLen {
+			return nil, errShortPacket
+		}
+
+		dst := &net.IPNet{
+			IP:   net.IP(b[2 : 2+ipLen]).Mask(net.CIDRMask(ones, ipLen*8)),
+			Mask: net.CIDRMask(ones, ipLen*8),
+		}
+
+		subnets = append(subnets, config.Subnet{
+			Prefix: dst.String(),
+			Weight: int(binary.BigEndian.Uint16(b[2+ipLen:])),
+			Metric: int(binary.BigEndian.Uint32(b[4+ipLen:])),
+		})
+
+		b = b[advertEntrySize+ipLen:]
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+func TestMarshalAdverts(t *testing.T) {
+	subnets := []config.Subnet{
+		{Prefix: "10.0.3.0/24", Weight: 2, Metric: 10},
+		{Prefix: "2001:db8:1::/48", Weight: 1},
+	}
+
+	msgs := marshalAdverts(ctrlRouteAdvertise, subnets)
+	if len(msgs) != 1 || msgs[0][0] != ctrlRouteAdvertise {
+		t.Fatal("expected one advertisement but got,", len(msgs))
+	}
+
+	decoded, err := unmarshalAdverts(msgs[0][1:])
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(decoded) != 2 || decoded[0] != subnets[0] || decoded[1] != subnets[1] {
+		t.Error("unexpected subnets,", decoded)
+	}
+
+	if _, err := unmarshalAdverts(msgs[0][1:10]); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	// large advertisements are split
+	subnets = nil
+	for i := 0; i < 200; i++ {
+		subnets = append(subnets, config.Subnet{Prefix: fmt.Sprintf("10.%d.0.0/16", i)})
+	}
+
+	msgs = marshalAdverts(ctrlRouteAdvertise, subnets)
+	n := 0
+	for _, msg := range msgs {
+		if len(msg) > maxAdvertSize {
+			t.Error("expected max advertisement size but got,", len(msg))
+		}
+		decoded, _ := unmarshalAdverts(msg[1:])
+		n += len(decoded)
+	}
+
+	if len(msgs) < 2 || n != 200 {
+		t.Error("expected 200 subnets at several messages but got,", len(msgs), n)
+	}
+}
+
+func TestLearnRoutes(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	s2.Router = router.New(context.Background())
+	s2.Config.Routing.Learn = true
+	s2.Config.Routing.Accept = []string{"10.0.0.0/8"}
+
+	testHandshake(t, s1, s2)
+
+	if err := s1.Advertise(config.Subnet{Prefix: "10.0.3.1/24", Metric: 5}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s1.Advertise(config.Subnet{Prefix: "172.16.0.0/16"})
+
+	s1.sendAdverts(c1, ctrlRouteAdvertise, s1.adverts.advertised())
+	for _, b := range c1.out {
+		if _, err := s2.handle(c2, addr1, b); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	table := s2.Router.Table()
+	if nexthop := table.Get(net.ParseIP("10.0.3.1")); nexthop.String() != "192.168.55.10" {
+		t.Error("expected learned route via 192.168.55.10 but got,", nexthop)
+	}
+
+	if nexthop := table.Get(net.ParseIP("172.16.0.1")); nexthop != nil {
+		t.Error("expected not accepted subnet but got,", nexthop)
+	}
+
+	// a default route isn't accepted unless it's explicitly accepted
+	s2.Config.Routing.Accept = nil
+	_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+	if s2.accepted(dst) {
+		t.Error("expected not accepted default route")
+	}
+
+	s2.Config.Routing.Accept = []string{"0.0.0.0/0"}
+	if !s2.accepted(dst) {
+		t.Error("expected accepted default route")
+	}
+
+	// a prefix of the nodes endpoints isn't accepted
+	s2.Config.Routing.Accept = nil
+	_, dst, _ = net.ParseCIDR("192.168.55.0/24")
+	if s2.accepted(dst) {
+		t.Error("expected not accepted prefix of the nodes")
+	}
+
+	s2.relayServer = &net.UDPAddr{IP: net.ParseIP("203.0.113.100"), Port: 8087}
+	_, dst, _ = net.ParseCIDR("203.0.113.0/24")
+	if s2.accepted(dst) {
+		t.Error("expected not accepted prefix of the relay server")
+	}
+	s2.relayServer = nil
+
+	s2.Config.Routing.Accept = []string{"10.0.0.0/8"}
+
+	routes := s2.Routes()
+	if len(routes.Learned) != 1 || routes.Learned[0].Prefix != "10.0.3.0/24" || routes.Learned[0].Metric != 5 {
+		t.Error("unexpected learned routes,", routes.Learned)
+	}
+
+	// withdraw
+	if err := s1.Withdraw("10.0.3.0/24"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	c1.out = nil
+	<-s1.adverts.changes
+	<-s1.adverts.changes
+	c := <-s1.adverts.changes
+	if !c.withdraw {
+		t.Fatal("expected withdrawal")
+	}
+	s1.sendAdverts(c1, ctrlRouteWithdraw, []config.Subnet{c.subnet})
+	s2.handle(c2, addr1, c1.out[0])
+
+	if nexthop := table.Get(net.ParseIP("10.0.3.1")); nexthop != nil {
+		t.Error("expected withdrawn route but got,", nexthop)
+	}
+
+	// expiry
+	s1.sendAdverts(c1, ctrlRouteAdvertise, []config.Subnet{{Prefix: "10.0.4.0/24"}})
+	s2.handle(c2, addr1, c1.out[len(c1.out)-1])
+
+	s2.adverts.Lock()
+	for key, learned := range s2.adverts.learned {
+		learned.expires = time.Now().Add(-time.Second)
+		s2.adverts.learned[key] = learned
+	}
+	s2.adverts.Unlock()
+
+	s2.expireLearned()
+	if nexthop := table.Get(net.ParseIP("10.0.4.1")); nexthop != nil {
+		t.Error("expected expired route but got,", nexthop)
+	}
+}
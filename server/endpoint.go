@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// roam learns the peer's endpoint from the source address of an
+// authenticated packet, the replies reach a peer behind a nat
+// and a peer which its address or port has been changed. the peer
+// is reached the same way that it's heard, directly or relayed.
+// the endpoint is only learned once learn is set, the shared key
+// doesn't authenticate the peer so its packets don't change it
+func (s *Server) roam(p *peer, addr net.Addr, learn bool) {
+	if a, ok := addr.(*relayedAddr); ok {
+		if p.setRelayed(a.server) {
+			log.Printf("node %s is relayed by %s", p.getNode().Name, a.server)
+		}
+		return
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	if learn {
+		_, detect := s.detection()
+		if p.setEndpoint(udpAddr, time.Now().Add(-detect).UnixNano()) {
+			log.Printf("node %s endpoint is %s", p.getNode().Name, udpAddr)
+			s.updateUnderlay()
+		}
+	} else if !p.isEndpoint(udpAddr) {
+		return
+	}
+
+	if p.setRelayed(nil) {
+		log.Printf("node %s is direct", p.getNode().Name)
+	}
+}
+
+// punch sends a punch to the peer to open the nat mapping toward
+// it, the peers which punch at the same time can reach each other
+// through their nats (simultaneous open)
+func (s *Server) punch(conn net.PacketConn, addr net.Addr) {
+	if _, err := conn.WriteTo(marshalPunch(), addr); err != nil {
+		log.Println(err)
+	}
+}
+
+// handlePunch probes the configured peer which is punching and is not
+// up yet, so both sides send at the same time. it's not authenticated
+// so it doesn't change the endpoint and it's replied once a second at most
+func (s *Server) handlePunch(conn net.PacketConn, addr net.Addr) error {
+	p := s.peerOf(addr)
+	if p == nil || p.getState() == peerUp {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.punched)
+	if now-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&p.punched, last, now) {
+		return nil
+	}
+
+	s.punch(conn, p.endpoint())
+	s.probe(conn, p, p.endpoint())
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+func TestRoaming(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	s1.Router = router.New(context.Background())
+	testHandshake(t, s1, s2)
+
+	c1, c2 := &testConn{}, &testConn{}
+
+	// the node 2 is behind a nat
+	nat := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40123}
+
+	p1 := s2.peers.get(s1.node.Address)
+	b, err := s2.seal(c2, p1, []byte("radvpn"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err := s1.handle(c1, nat, b); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	p2 := s1.peers.get(s2.node.Address)
+	if p2.endpoint().String() != nat.String() {
+		t.Error("expected", nat, "but got,", p2.endpoint())
+	}
+
+	// the learned endpoint is excluded from the default routes
+	if ips := p2.endpointIPs(); len(ips) != 2 || !ips[1].Equal(nat.IP) {
+		t.Error("expected the learned endpoint ip but got,", ips)
+	}
+
+	// an unauthenticated packet doesn't change the endpoint
+	spoofed := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8085}
+	b[len(b)-1] ^= 0xff
+	s1.handle(c1, spoofed, b)
+	if p2.endpoint().String() != nat.String() {
+		t.Error("expected", nat, "but got,", p2.endpoint())
+	}
+
+	// the learned endpoint is kept by the config update
+	s1.updatePeers()
+	if p2.endpoint().String() != nat.String() {
+		t.Error("expected", nat, "but got,", p2.endpoint())
+	}
+
+	// the node's port
+	s1.Config.Nodes[1].Node.Port = 9000
+	s1.updatePeers()
+	if p2.endpoint().String() != "192.168.55.20:9000" {
+		t.Error("expected 192.168.55.20:9000 but got,", p2.endpoint())
+	}
+}
+
+func TestPunch(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1 := &testConn{}
+	addr2 := &net.UDPAddr{IP: net.ParseIP(s2.node.Address), Port: 8085}
+
+	if _, err := s1.handle(c1, addr2, marshalPunch()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// a punch and a handshake initiation
+	if len(c1.out) != 2 || c1.out[0][1] != msgPunch || c1.out[1][1] != msgHandshakeInit {
+		t.Fatal("expected punch and handshake initiation but got,", len(c1.out))
+	}
+
+	// rate limited
+	s1.handle(c1, addr2, marshalPunch())
+	if len(c1.out) != 2 {
+		t.Error("expected no reply but got,", len(c1.out))
+	}
+
+	// unknown address
+	s1.handle(c1, &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8085}, marshalPunch())
+	if len(c1.out) != 2 {
+		t.Error("expected no reply but got,", len(c1.out))
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	s1.Config.Server.Keepalive = 10
+	s1.Config.Nodes[1].Node.Endpoints = []config.Endpoint{
+		{Address: "192.168.55.20", Priority: 10},
+		{Address: "2001:db8::20", Priority: 20},
+	}
+	s1.updatePeers()
+	testHandshake(t, s1, s2)
+
+	primary := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+	backup := &net.UDPAddr{IP: net.ParseIP("2001:db8::20"), Port: 8085}
+
+	p1 := s2.peers.get(s1.node.Address)
+	p2 := s1.peers.get(s2.node.Address)
+	c1, c2 := &testConn{}, &testConn{}
+
+	send := func(from *net.UDPAddr) {
+		b, err := s2.seal(c2, p1, []byte("radvpn"))
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := s1.handle(c1, from, b); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if alternates := p2.alternates(); len(alternates) != 1 || alternates[0].String() != backup.String() {
+		t.Error("expected", backup, "but got,", alternates)
+	}
+
+	// the backup doesn't replace the alive primary
+	send(primary)
+	send(backup)
+	if p2.endpoint().String() != primary.String() {
+		t.Error("expected", primary, "but got,", p2.endpoint())
+	}
+
+	// the primary isn't heard anymore
+	p2.endpointOf(primary).seen = 1
+	send(backup)
+	if p2.endpoint().String() != backup.String() {
+		t.Error("expected", backup, "but got,", p2.endpoint())
+	}
+
+	// fails back to the primary
+	send(primary)
+	if p2.endpoint().String() != primary.String() {
+		t.Error("expected", primary, "but got,", p2.endpoint())
+	}
+
+	// a packet from the backup ip finds the peer
+	if p := s1.peerOf(backup); p != p2 {
+		t.Error("expected the peer of the backup endpoint")
+	}
+
+	p2.nextEndpoint()
+	if p2.endpoint().String() != backup.String() {
+		t.Error("expected", backup, "but got,", p2.endpoint())
+	}
+}
+
+func TestEndpointPorts(t *testing.T) {
+	s1, _ := testHandshakeServers(t)
+	s1.Config.Nodes[1].Node.Endpoints = []config.Endpoint{
+		{Address: "192.168.55.20", Port: 8085, Priority: 10},
+		{Address: "192.168.55.20", Port: 8086, Priority: 20},
+	}
+	s1.updatePeers()
+
+	primary := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+	backup := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8086}
+	p2 := s1.peers.get("192.168.55.20")
+
+	if alternates := p2.alternates(); len(alternates) != 1 || alternates[0].String() != backup.String() {
+		t.Error("expected", backup, "but got,", alternates)
+	}
+
+	p2.setEndpoint(backup, 0)
+	if e := p2.endpointOf(backup); e == nil || e.seen == 0 || p2.endpointOf(primary).seen != 0 {
+		t.Error("expected the backup endpoint seen")
+	}
+
+	// an unknown port of the ip is ambiguous
+	if e := p2.endpointOf(&net.UDPAddr{IP: primary.IP, Port: 40000}); e != nil {
+		t.Error("expected no endpoint but got,", e.addr)
+	}
+
+	p2.nextEndpoint()
+	if p2.endpoint().String() != primary.String() {
+		t.Error("expected", primary, "but got,", p2.endpoint())
+	}
+
+	p2.nextEndpoint()
+	if p2.endpoint().String() != backup.String() {
+		t.Error("expected", backup, "but got,", p2.endpoint())
+	}
+}
+
+func TestSharedKeyEndpoints(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Crypto.Type = "gcm"
+	cfg.Crypto.Key = "6368616e676520746869732070617373776f726420746f206120736563726574"
+	cfg.Nodes = []struct {
+		config.Node `yaml:"node"`
+	}{
+		{config.Node{Name: "node1", Address: "192.168.55.10"}},
+		{config.Node{Name: "node2", Address: "192.168.55.20", Endpoints: []config.Endpoint{
+			{Address: "1.2.3.4", Port: 8085},
+		}}},
+		{config.Node{Name: "node3", Address: "192.168.55.30", Endpoints: []config.Endpoint{
+			{Address: "1.2.3.4", Port: 8086},
+		}}},
+	}
+
+	s := &Server{
+		Config: cfg,
+		node:   cfg.Nodes[0].Node,
+		port:   "8085",
+		peers:  newPeers(),
+	}
+
+	s.initCrypto()
+	s.updatePeers()
+
+	p2 := s.peers.get("192.168.55.20")
+	p3 := s.peers.get("192.168.55.30")
+
+	// the nodes behind the same nat are found by the port
+	if p := s.peerOf(&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8085}); p != p2 {
+		t.Error("expected node2 but got,", p)
+	}
+
+	if p := s.peerOf(&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8086}); p != p3 {
+		t.Error("expected node3 but got,", p)
+	}
+
+	if p := s.peerOf(&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 9000}); p != nil {
+		t.Error("expected unknown peer of the shared ip but got,", p.node.Name)
+	}
+
+	// a shared key packet doesn't change the endpoint
+	c := &testConn{}
+	b, _ := s.seal(c, p3, []byte("radvpn"))
+	s.handle(c, &net.UDPAddr{IP: net.ParseIP("192.168.55.30"), Port: 9000}, b)
+	if p3.endpoint().String() != "1.2.3.4:8086" {
+		t.Error("expected 1.2.3.4:8086 but got,", p3.endpoint())
+	}
+}
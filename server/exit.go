@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+// forwarding are the kernel parameters which enable the ip forwarding
+var forwarding = []string{
+	"/proc/sys/net/ipv4/ip_forward",
+	"/proc/sys/net/ipv6/conf/all/forwarding",
+}
+
+// masquerade manages the source nat of the tunneled traffic at
+// an exit node by iptables, the rules are kept by the source prefix
+type masquerade struct {
+	sync.Mutex
+
+	ifname  string
+	sources map[string]bool
+
+	// the forwarding parameters before the exit node enabled them
+	sysctls map[string][]byte
+
+	// runs the iptables command, it's replaced by the tests
+	run func(name string, args ...string) error
+}
+
+func newMasquerade(ifname string) *masquerade {
+	return &masquerade{
+		ifname:  ifname,
+		sources: make(map[string]bool),
+		sysctls: make(map[string][]byte),
+		run: func(name string, args ...string) error {
+			out, err := exec.Command(name, args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, out)
+			}
+			return nil
+		},
+	}
+}
+
+// rule runs the iptables operation of the source prefix, the traffic
+// from the source which leaves by the other interfaces is masqueraded
+func (m *masquerade) rule(op, source string) error {
+	cmd := "ip6tables"
+	if ip, _, err := net.ParseCIDR(source); err == nil && ip.To4() != nil {
+		cmd = "iptables"
+	}
+
+	return m.run(cmd, "-t", "nat", op, "POSTROUTING", "-s", source,
+		"!", "-o", m.ifname, "-j", "MASQUERADE")
+}
+
+// update masquerades the sources and removes the old ones, it returns
+// an error once a source can't be masqueraded as its traffic would be
+// dropped silently
+func (m *masquerade) update(sources []string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var err error
+
+	want := make(map[string]bool)
+	for _, source := range sources {
+		want[source] = true
+
+		if m.sources[source] {
+			continue
+		}
+
+		// the rule of a previous run
+		if m.rule("-C", source) != nil {
+			if e := m.rule("-A", source); e != nil {
+				if err == nil {
+					err = e
+				}
+				continue
+			}
+		}
+
+		m.sources[source] = true
+	}
+
+	for source := range m.sources {
+		if want[source] {
+			continue
+		}
+
+		if err := m.rule("-D", source); err != nil {
+			log.Println(err)
+		}
+
+		delete(m.sources, source)
+	}
+
+	return err
+}
+
+// forward enables the ip forwarding and keeps the previous values
+func (m *masquerade) forward() error {
+	for _, path := range forwarding {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			return err
+		}
+
+		m.sysctls[path] = b
+	}
+
+	return nil
+}
+
+// restore sets the forwarding parameters back to their previous values
+func (m *masquerade) restore() {
+	for path, b := range m.sysctls {
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			log.Println(err)
+		}
+
+		delete(m.sysctls, path)
+	}
+}
+
+// exitSources returns the prefixes of the other nodes which
+// their traffic is masqueraded at the exit node
+func (s *Server) exitSources() []string {
+	var sources []string
+
+	for _, nodes := range s.Config.Nodes {
+		node := nodes.Node
+		if node.Name == s.node.Name {
+			continue
+		}
+
+		for _, prefix := range node.GetPrivateSubnets() {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				continue
+			}
+
+			if router.IsDefault(ipnet) {
+				continue
+			}
+
+			sources = append(sources, ipnet.String())
+		}
+
+		for _, addr := range node.GetPrivateAddresses() {
+			if _, ipnet, err := net.ParseCIDR(addr); err == nil {
+				sources = append(sources, ipnet.String())
+			}
+		}
+	}
+
+	return sources
+}
+
+// setupExit enables the ip forwarding and masquerades the other
+// nodes traffic once the local node is an exit node
+func (s *Server) setupExit() error {
+	if !s.node.Exit {
+		return nil
+	}
+
+	if s.nat == nil {
+		nat := newMasquerade("radvpn")
+		if err := nat.forward(); err != nil {
+			nat.restore()
+			return err
+		}
+
+		s.nat = nat
+	}
+
+	return s.nat.update(s.exitSources())
+}
+
+// updateUnderlay sets the configured and the learned addresses of
+// the direct peers and the relay server which are excluded from the
+// default routes through the tunnel, it's updated once an endpoint
+// is learned
+func (s *Server) updateUnderlay() {
+	if s.Router == nil {
+		return
+	}
+
+	var addrs []net.IP
+	for _, p := range s.directPeers() {
+		addrs = append(addrs, p.endpointIPs()...)
+	}
+
+	if s.relayServer != nil {
+		addrs = append(addrs, s.relayServer.IP)
+	}
+
+	s.Router.Table().SetUnderlay(addrs)
+}
+
+// Cleanup removes the nat rules, restores the ip forwarding
+// and removes the kernel routes
+func (s *Server) Cleanup() {
+	if s.nat != nil {
+		if err := s.nat.update(nil); err != nil {
+			log.Println(err)
+		}
+		s.nat.restore()
+	}
+
+	if err := s.Router.Table().Cleanup(); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasquerade(t *testing.T) {
+	rules := make(map[string]bool)
+
+	m := newMasquerade("radvpn")
+	m.run = func(name string, args ...string) error {
+		rule := name + " " + strings.Join(append(args[:2:2], args[3:]...), " ")
+		switch args[2] {
+		case "-C":
+			if !rules[rule] {
+				return errors.New("no such rule")
+			}
+		case "-A":
+			rules[rule] = true
+		case "-D":
+			delete(rules, rule)
+		}
+		return nil
+	}
+
+	m.update([]string{"10.0.1.0/24", "fd00:1::/64"})
+	if len(rules) != 2 {
+		t.Fatal("expected 2 rules but got,", rules)
+	}
+
+	if !rules["ip6tables -t nat POSTROUTING -s fd00:1::/64 ! -o radvpn -j MASQUERADE"] {
+		t.Error("expected ip6tables rule but got,", rules)
+	}
+
+	// the existing rule isn't added twice
+	m = newMasquerade("radvpn")
+	m.run = func(name string, args ...string) error {
+		if args[2] == "-A" {
+			t.Error("unexpected rule addition,", args)
+		}
+		return nil
+	}
+	m.update([]string{"10.0.1.0/24"})
+
+	m.run = func(name string, args ...string) error {
+		if args[2] != "-D" || args[4] != "-s" || args[5] != "10.0.1.0/24" {
+			t.Error("expected 10.0.1.0/24 deletion but got,", args)
+		}
+		return nil
+	}
+	m.update(nil)
+
+	if len(m.sources) != 0 {
+		t.Error("expected no source but got,", m.sources)
+	}
+
+	// the iptables command isn't available
+	m.run = func(name string, args ...string) error {
+		return errors.New("executable file not found")
+	}
+	if err := m.update([]string{"10.0.1.0/24"}); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestExitSources(t *testing.T) {
+	s := testServers(t, 2)[0]
+	s.Config.Nodes[1].Node.Exit = true
+	s.Config.Nodes[1].Node.PrivateAddresses = []string{"10.0.2.1/24"}
+
+	sources := s.exitSources()
+	if len(sources) != 1 || sources[0] != "10.0.2.0/24" {
+		t.Error("expected 10.0.2.0/24 but got,", sources)
+	}
+
+	irb := s.Config.GetIRB()
+	if subnets := irb[s.Config.Nodes[1].Node.Address]; len(subnets) != 2 {
+		t.Error("expected the default routes of the exit node but got,", subnets)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ip_forward")
+	ioutil.WriteFile(path, []byte("0\n"), 0644)
+
+	defer func(f []string) { forwarding = f }(forwarding)
+	forwarding = []string{path}
+
+	m := newMasquerade("radvpn")
+	if err := m.forward(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "1" {
+		t.Error("expected 1 but got,", string(b))
+	}
+
+	m.restore()
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "0\n" {
+		t.Error("expected 0 but got,", string(b))
+	}
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/crypto"
+)
+
+const timestampSize = 8
+
+var (
+	errNoSession         = errors.New("no session, handshake initiated")
+	errHandshakeDisabled = errors.New("handshake is not enabled")
+	errReplay            = errors.New("replayed packet")
+)
+
+// initiate sends a handshake initiation to the peer unless
+// there is one in flight
+func (s *Server) initiate(conn net.PacketConn, p *peer) error {
+	key := s.key()
+	if key == nil {
+		return errHandshakeDisabled
+	}
+
+	p.Lock()
+	if p.publicKey.IsZero() {
+		p.Unlock()
+		return fmt.Errorf("node %s has no public key", p.node.Name)
+	}
+
+	if p.handshake != nil && time.Since(p.hsTime) < rekeyTimeout {
+		p.Unlock()
+		return nil
+	}
+
+	p.hsTime = time.Now()
+	p.Unlock()
+
+	hs := crypto.NewInitiator(*key, p.publicKey)
+
+	ts := make([]byte, timestampSize)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+
+	msg, err := hs.WriteInit(ts)
+	if err != nil {
+		return err
+	}
+
+	index := s.peers.addHandshake(p)
+
+	p.Lock()
+	old := p.hsIndex
+	p.handshake = hs
+	p.hsIndex = index
+	p.Unlock()
+
+	if old != 0 {
+		s.peers.del(old)
+	}
+
+	_, err = conn.WriteTo(marshalHandshakeInit(index, msg), p.endpoint())
+
+	return err
+}
+
+// handleInit responds to a handshake initiation from a configured node
+func (s *Server) handleInit(conn net.PacketConn, addr net.Addr, h msgHeader, b []byte) error {
+	key := s.key()
+	if key == nil {
+		return errHandshakeDisabled
+	}
+
+	if len(b) < handshakeInitHdrSize+crypto.InitSize(timestampSize) {
+		return errShortPacket
+	}
+
+	sender := h.session
+
+	hs := crypto.NewResponder(*key)
+	payload, err := hs.ReadInit(b[handshakeInitHdrSize:])
+	if err != nil {
+		return fmt.Errorf("handshake from %s: %v", addr, err)
+	}
+
+	p := s.peers.getByKey(hs.RemoteStatic())
+	if p == nil {
+		return fmt.Errorf("handshake from %s: unknown peer", addr)
+	}
+
+	if len(payload) != timestampSize {
+		return fmt.Errorf("handshake from %s: invalid payload", addr)
+	}
+
+	ts := binary.BigEndian.Uint64(payload)
+
+	p.Lock()
+	if ts <= p.timestamp {
+		p.Unlock()
+		return fmt.Errorf("handshake from %s: replayed initiation", addr)
+	}
+	p.timestamp = ts
+	p.Unlock()
+
+	s.roam(p, addr, true)
+	s.alive(p)
+
+	msg, err := hs.WriteResponse(nil)
+	if err != nil {
+		return err
+	}
+
+	sess, err := s.newSession(p, hs, 0, sender)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.WriteTo(marshalHandshakeResp(sess.local, sender, msg), addr)
+
+	return err
+}
+
+// handleResp completes an initiated handshake
+func (s *Server) handleResp(addr net.Addr, h msgHeader, b []byte) error {
+	if len(b) < handshakeRespHdrSize+crypto.ResponseSize(0) {
+		return errShortPacket
+	}
+
+	sender := binary.BigEndian.Uint32(b[msgHeaderSize:])
+	receiver := h.session
+
+	p := s.peers.handshake(receiver)
+	if p == nil {
+		return errors.New("handshake response: unknown index")
+	}
+
+	p.Lock()
+	hs := p.handshake
+	if hs == nil || p.hsIndex != receiver {
+		p.Unlock()
+		return errors.New("handshake response: no handshake in flight")
+	}
+	p.handshake = nil
+	p.hsIndex = 0
+	p.Unlock()
+
+	if _, err := hs.ReadResponse(b[handshakeRespHdrSize:]); err != nil {
+		s.peers.del(receiver)
+		return fmt.Errorf("handshake response from %s: %v", p.node.Name, err)
+	}
+
+	s.roam(p, addr, true)
+	s.alive(p)
+
+	_, err := s.newSession(p, hs, receiver, sender)
+
+	return err
+}
+
+// newSession derives the transport ciphers and makes the session
+// current for the peer
+func (s *Server) newSession(p *peer, hs *crypto.Handshake, local, remote uint32) (*session, error) {
+	send, recv, err := hs.Split()
+	if err != nil {
+		return nil, err
+	}
+
+	key := s.key()
+	if key == nil {
+		return nil, errHandshakeDisabled
+	}
+
+	// the local index is set once the local node initiated
+	publicKey := key.Public()
+	lower := bytes.Compare(publicKey[:], p.publicKey[:]) < 0
+
+	sess := &session{
+		local:     local,
+		remote:    remote,
+		created:   time.Now(),
+		preferred: (local != 0) == lower,
+		peer:      p,
+	}
+
+	sess.tx, err = crypto.NewCipher(s.Config.Crypto.Type, send)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.rx, err = crypto.NewCipher(s.Config.Crypto.Type, recv)
+	if err != nil {
+		return nil, err
+	}
+
+	s.peers.addSession(sess)
+
+	if expired := p.setSession(sess); expired != nil && expired.local != 0 {
+		s.peers.del(expired.local)
+	}
+
+	return sess, nil
+}
+
+// seal encrypts the packet for the peer, it initiates a handshake
+// if there is no session yet or the session should be rekeyed
+func (s *Server) seal(conn net.PacketConn, p *peer, b []byte) ([]byte, error) {
+	if s.Config.Server.Insecure {
+		return marshalData(0, 0, b), nil
+	}
+
+	sess := p.txSession()
+	if sess != nil && s.key() != nil && time.Since(sess.created) > s.rejectAfter() {
+		sess = nil
+	}
+
+	if sess == nil {
+		if err := s.initiate(conn, p); err != nil {
+			return nil, err
+		}
+		return nil, errNoSession
+	}
+
+	counter := sess.next()
+
+	// the counter is encrypted along with the packet to
+	// authenticate the counter at the header
+	plainData := make([]byte, counterSize+len(b))
+	binary.BigEndian.PutUint64(plainData, counter)
+	copy(plainData[counterSize:], b)
+
+	b, err := sess.tx.Encrypt(plainData)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.key() != nil && s.needsRekey(sess, counter) {
+		if err := s.initiate(conn, p); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return marshalData(sess.remote, counter, b), nil
+}
+
+// needsRekey reports whether the session reached the rekey
+// packets or time limits
+func (s *Server) needsRekey(sess *session, counter uint64) bool {
+	interval := time.Duration(s.Config.Crypto.RekeyInterval) * time.Second
+
+	return counter >= uint64(s.Config.Crypto.RekeyPackets) ||
+		time.Since(sess.created) >= interval
+}
+
+// rejectAfter returns the age that a session can't be used anymore
+func (s *Server) rejectAfter() time.Duration {
+	return 3 * time.Duration(s.Config.Crypto.RekeyInterval) * time.Second
+}
+
+// overlap returns the time that a replaced session can still decrypt
+func (s *Server) overlap() time.Duration {
+	return time.Duration(s.Config.Crypto.RekeyOverlap) * time.Second
+}
+
+// open decrypts the data packet based on its session and
+// rejects the replayed packets, it returns the sender peer
+// which is nil for an unknown peer at insecure mode
+func (s *Server) open(addr net.Addr, b []byte) (*peer, []byte, error) {
+	index, counter, payload, err := unmarshalData(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.Config.Server.Insecure {
+		return s.peerOf(addr), payload, nil
+	}
+
+	if index == 0 {
+		if s.key() != nil {
+			return nil, nil, fmt.Errorf("data from %s: shared key is not accepted", addr)
+		}
+
+		sess, b, err := s.openShared(addr, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b, err = s.verify(sess, counter, b)
+
+		return sess.peer, b, err
+	}
+
+	sess := s.peers.session(index)
+	if sess == nil {
+		return nil, nil, fmt.Errorf("data from %s: unknown session", addr)
+	}
+
+	if sess.expired(s.overlap()) {
+		s.peers.del(index)
+		return nil, nil, fmt.Errorf("data from %s: expired session", addr)
+	}
+
+	if !sess.replay.check(counter) {
+		atomic.AddUint64(&sess.peer.replayed, 1)
+		return nil, nil, errReplay
+	}
+
+	b, err = sess.rx.Decrypt(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err = s.verify(sess, counter, b)
+
+	return sess.peer, b, err
+}
+
+// verify checks the encrypted counter against the header
+// counter and updates the replay window
+func (s *Server) verify(sess *session, counter uint64, b []byte) ([]byte, error) {
+	if len(b) < counterSize || binary.BigEndian.Uint64(b) != counter {
+		return nil, errors.New("invalid counter")
+	}
+
+	if !sess.replay.update(counter) {
+		atomic.AddUint64(&sess.peer.replayed, 1)
+		return nil, errReplay
+	}
+
+	return b[counterSize:], nil
+}
+
+// openShared decrypts the data by the shared key of the sender, the
+// previous key is tried during the overlap once the key has been changed
+func (s *Server) openShared(addr net.Addr, payload []byte) (*session, []byte, error) {
+	p := s.peerOf(addr)
+	if p == nil {
+		return nil, nil, fmt.Errorf("data from %s: unknown peer", addr)
+	}
+
+	current, previous := p.sessions()
+	if current == nil {
+		return nil, nil, fmt.Errorf("data from %s: unknown session", addr)
+	}
+
+	b, err := current.rx.Decrypt(payload)
+	if err != nil && previous != nil && !previous.expired(s.overlap()) {
+		b, err = previous.rx.Decrypt(payload)
+		return previous, b, err
+	}
+
+	return current, b, err
+}
+
+// handle dispatches the packet based on its type and returns
+// the ip packet for data messages
+func (s *Server) handle(conn net.PacketConn, addr net.Addr, b []byte) ([]byte, error) {
+	h, err := parseMsgHeader(b, addr.String())
+	if err != nil {
+		if _, ok := err.(errVersion); ok {
+			s.replyVersion(conn, addr)
+		}
+		return nil, err
+	}
+
+	switch h.typ {
+	case msgHandshakeInit:
+		return nil, s.handleInit(conn, addr, h, b)
+	case msgHandshakeResp:
+		return nil, s.handleResp(addr, h, b)
+	case msgData:
+		p, b, err := s.open(addr, b)
+		if err != nil || p == nil {
+			return b, err
+		}
+
+		if !s.Config.Server.Insecure {
+			s.roam(p, addr, s.key() != nil)
+		}
+		s.alive(p)
+
+		if isControl(b) {
+			return nil, s.control(conn, addr, p, b)
+		}
+
+		if s.forward(conn, p, b) {
+			return nil, nil
+		}
+
+		return b, nil
+	case msgPunch:
+		return nil, s.handlePunch(conn, addr)
+	case msgRelay:
+		return s.handleRelay(conn, addr, b)
+	case msgVersion:
+		return nil, fmt.Errorf("peer %s supports protocol version %d, local version is %d",
+			addr, h.version, protoVersion)
+	}
+
+	return nil, fmt.Errorf("unknown message type %d from %s", h.typ, addr)
+}
+
+// replyVersion lets the peer know the local protocol version,
+// it replies once a second at most
+func (s *Server) replyVersion(conn net.PacketConn, addr net.Addr) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.versionReplied)
+	if now-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&s.versionReplied, last, now) {
+		return
+	}
+
+	conn.WriteTo(marshalVersion(), addr)
+}
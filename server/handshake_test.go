@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/crypto"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+type testConn struct {
+	net.PacketConn
+	out   [][]byte
+	addrs []net.Addr
+}
+
+func (c *testConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out = append(c.out, b)
+	c.addrs = append(c.addrs, addr)
+	return len(b), nil
+}
+
+func testHandshakeServers(t *testing.T) (*Server, *Server) {
+	servers := testServers(t, 2)
+	return servers[0], servers[1]
+}
+
+// testServers returns n servers of the nodes 192.168.55.10, .20, ...
+func testServers(t *testing.T, n int) []*Server {
+	cfg := &config.Config{}
+	cfg.Crypto.Type = "gcm"
+	cfg.Crypto.RekeyInterval = 120
+	cfg.Crypto.RekeyPackets = 1 << 30
+	cfg.Crypto.RekeyOverlap = 30
+
+	keys := []crypto.PrivateKey{}
+	for i := 1; i <= n; i++ {
+		k, _ := crypto.GeneratePrivateKey()
+		keys = append(keys, k)
+		cfg.Nodes = append(cfg.Nodes, struct {
+			config.Node `yaml:"node"`
+		}{config.Node{
+			Name:      fmt.Sprintf("node%d", i),
+			Address:   fmt.Sprintf("192.168.55.%d0", i),
+			PublicKey: k.Public().String(),
+		}})
+	}
+
+	servers := []*Server{}
+	for i, k := range keys {
+		k := k
+		s := &Server{
+			Config:  cfg,
+			node:    cfg.Nodes[i].Node,
+			port:    "8085",
+			peers:   newPeers(),
+			adverts: newAdverts(),
+		}
+		s.setKey(&k)
+		s.updatePeers()
+		servers = append(servers, s)
+	}
+
+	return servers
+}
+
+func testHandshake(t *testing.T, s1, s2 *Server) {
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP(s1.node.Address), Port: 8085}
+	addr2 := &net.UDPAddr{IP: net.ParseIP(s2.node.Address), Port: 8085}
+
+	s1.initiate(c1, s1.peers.get(s2.node.Address))
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err := s1.handle(c1, addr2, c2.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestCrossingHandshake(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	s1.Config.Crypto.RekeyOverlap = 0
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+
+	p1 := s2.peers.get("192.168.55.10")
+	p2 := s1.peers.get("192.168.55.20")
+
+	// both nodes initiate at the same time
+	s1.initiate(c1, p2)
+	s2.initiate(c2, p1)
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := s1.handle(c1, addr2, c2.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := s1.handle(c1, addr2, c2.out[1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := s2.handle(c2, addr1, c1.out[1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if p1.session().local != p2.session().remote || p2.session().local != p1.session().remote {
+		t.Fatal("expected the same session at both nodes")
+	}
+
+	// the replaced sessions expire right away without overlap
+	time.Sleep(time.Millisecond)
+
+	b, _ := s1.seal(c1, p2, []byte("vpn"))
+	if b, err := s2.handle(c2, addr1, b); err != nil || string(b) != "vpn" {
+		t.Error("expected vpn but got,", string(b), err)
+	}
+
+	b, _ = s2.seal(c2, p1, []byte("radvpn"))
+	if b, err := s1.handle(c1, addr2, b); err != nil || string(b) != "radvpn" {
+		t.Error("expected radvpn but got,", string(b), err)
+	}
+}
+
+func TestHandshakeSession(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+
+	p2 := s1.peers.get("192.168.55.20")
+	if _, err := s1.seal(c1, p2, []byte("vpn")); err != errNoSession {
+		t.Fatal("expected no session error but got,", err)
+	}
+
+	if len(c1.out) != 1 || c1.out[0][1] != msgHandshakeInit {
+		t.Fatal("expected handshake initiation")
+	}
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(c2.out) != 1 || c2.out[0][1] != msgHandshakeResp {
+		t.Fatal("expected handshake response")
+	}
+
+	if _, err := s1.handle(c1, addr2, c2.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err := s1.seal(c1, p2, []byte("vpn"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err = s2.handle(c2, addr1, b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if string(b) != "vpn" {
+		t.Error("expected vpn but got,", string(b))
+	}
+
+	p1 := s2.peers.get("192.168.55.10")
+	b, _ = s2.seal(c2, p1, []byte("radvpn"))
+	b, err = s1.handle(c1, addr2, b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if string(b) != "radvpn" {
+		t.Error("expected radvpn but got,", string(b))
+	}
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	s1.initiate(c1, s1.peers.get("192.168.55.20"))
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err == nil {
+		t.Error("expected replayed initiation error but got nil")
+	}
+}
+
+func TestHandshakeUnknownPeer(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	k, _ := crypto.GeneratePrivateKey()
+	s1.setKey(&k)
+	s1.initiate(c1, s1.peers.get("192.168.55.20"))
+
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err == nil {
+		t.Error("expected unknown peer error but got nil")
+	}
+
+	if len(c2.out) != 0 {
+		t.Error("expected no response to an unknown peer")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	testHandshake(t, s1, s2)
+
+	s1.Config.Crypto.RekeyPackets = 2
+	p2 := s1.peers.get("192.168.55.20")
+
+	old, _ := s1.seal(c1, p2, []byte("vpn"))
+	if len(c1.out) != 0 {
+		t.Fatal("unexpected rekey")
+	}
+
+	s1.seal(c1, p2, []byte("vpn"))
+	if len(c1.out) != 1 || c1.out[0][1] != msgHandshakeInit {
+		t.Fatal("expected rekey handshake initiation")
+	}
+
+	// responder switches to the new session
+	if _, err := s2.handle(c2, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// packets of the old session are accepted during the overlap
+	b, err := s2.handle(c2, addr1, old)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if string(b) != "vpn" {
+		t.Error("expected vpn but got,", string(b))
+	}
+
+	s2.Config.Crypto.RekeyOverlap = 0
+	time.Sleep(time.Millisecond)
+
+	if _, err := s2.handle(c2, addr1, old); err == nil {
+		t.Error("expected expired session error but got nil")
+	}
+}
+
+func TestSharedKeyRotation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Crypto.Type = "gcm"
+	cfg.Crypto.Key = "6368616e676520746869732070617373776f726420746f206120736563726574"
+	cfg.Crypto.RekeyOverlap = 30
+	cfg.Nodes = []struct {
+		config.Node `yaml:"node"`
+	}{
+		{config.Node{Name: "node1", Address: "192.168.55.10"}},
+		{config.Node{Name: "node2", Address: "192.168.55.20"}},
+	}
+
+	s := &Server{
+		Config: cfg,
+		node:   cfg.Nodes[0].Node,
+		port:   "8085",
+		peers:  newPeers(),
+	}
+
+	s.initCrypto()
+	s.updatePeers()
+
+	c := &testConn{}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+	p := s.peers.get("192.168.55.20")
+
+	old, _ := s.seal(c, p, []byte("vpn"))
+
+	cfg.Crypto.Key = "7368616e676520746869732070617373776f726420746f206120736563726574"
+	s.initCrypto()
+	s.updatePeers()
+
+	if p.session().tx != s.cipher {
+		t.Fatal("expected new shared key session")
+	}
+
+	if p.txSession() == p.session() {
+		t.Error("expected sending by the previous key during the overlap")
+	}
+
+	_, b, err := s.open(addr, old)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if string(b) != "vpn" {
+		t.Error("expected vpn but got,", string(b))
+	}
+}
+
+func TestReplayedData(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1 := &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	testHandshake(t, s1, s2)
+
+	b, _ := s1.seal(c1, s1.peers.get("192.168.55.20"), []byte("vpn"))
+
+	if _, _, err := s2.open(addr1, b); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, _, err := s2.open(addr1, b); err != errReplay {
+		t.Error("expected replayed packet error but got,", err)
+	}
+
+	// tampered header counter
+	b, _ = s1.seal(c1, s1.peers.get("192.168.55.20"), []byte("vpn"))
+	b[dataHdrSize-1]++
+
+	if _, _, err := s2.open(addr1, b); err == nil {
+		t.Error("expected invalid counter error but got nil")
+	}
+
+	if n := s2.peers.get("192.168.55.10").replayed; n != 1 {
+		t.Error("expected one replayed packet but got,", n)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1, c2 := &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+
+	testHandshake(t, s1, s2)
+
+	p2 := s1.peers.get("192.168.55.20")
+	p1 := s2.peers.get("192.168.55.10")
+
+	if p2.getState() != peerUp || p1.getState() != peerUp {
+		t.Fatal("unexpected peer states", p2.getState(), p1.getState())
+	}
+
+	s1.setPeerState(p2, peerDown)
+
+	s1.probe(c1, p2, p2.endpoint())
+
+	b, err := s2.handle(c2, addr1, c1.out[len(c1.out)-1])
+	if err != nil || b != nil {
+		t.Fatal("expected control message but got,", b, err)
+	}
+
+	if len(c2.out) != 1 {
+		t.Fatal("expected probe reply")
+	}
+
+	if _, err := s1.handle(c1, addr2, c2.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if p2.getState() != peerUp || p1.getState() != peerUp {
+		t.Error("expected up peers")
+	}
+
+	if p2.rtt <= 0 {
+		t.Error("expected round-trip time but got,", p2.rtt)
+	}
+}
+
+func TestDetection(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	c1 := &testConn{}
+
+	s1.Router = router.New(context.Background())
+	s1.Config.Detection.TxInterval = 200
+
+	interval, detect := s1.detection()
+	if interval != 200*time.Millisecond || detect != 600*time.Millisecond {
+		t.Fatal("expected 200ms/600ms but got,", interval, detect)
+	}
+
+	testHandshake(t, s1, s2)
+
+	_, dst, _ := net.ParseCIDR("10.0.2.0/24")
+	s1.Router.Table().Add(dst, net.ParseIP("192.168.55.20"))
+
+	p2 := s1.peers.get("192.168.55.20")
+
+	s1.detect(c1, detect)
+	if p2.getState() != peerUp || s1.Router.Table().Get(dst.IP) == nil {
+		t.Fatal("expected up peer and route")
+	}
+
+	atomic.StoreInt64(&p2.seen, time.Now().Add(-detect).UnixNano())
+	s1.detect(c1, detect)
+
+	if p2.getState() != peerDown {
+		t.Error("expected down peer")
+	}
+
+	if nexthop := s1.Router.Table().Get(dst.IP); nexthop != nil {
+		t.Error("expected withdrawn route but got,", nexthop)
+	}
+
+	status := s1.Status()
+	if len(status) != 1 || status[0].Name != "node2" || status[0].State != "down" || !status[0].Session {
+		t.Error("unexpected status,", status)
+	}
+}
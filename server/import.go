@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+// importer advertises the routes of a kernel routing table or
+// interfaces as the node's subnets (redistribute)
+type importer struct {
+	table  int
+	metric int
+	ifaces map[string]bool
+
+	// the imported prefixes by the kernel routes and their references
+	routes map[string]string
+	refs   map[string]int
+
+	advertise func(config.Subnet) error
+	withdraw  func(string) error
+	// reports whether the prefix contains an underlay address
+	underlay func(*net.IPNet) bool
+}
+
+func (s *Server) newImporter() *importer {
+	c := s.Config.Routing.Import
+
+	im := &importer{
+		table:     c.Table,
+		metric:    c.Metric,
+		ifaces:    make(map[string]bool),
+		routes:    make(map[string]string),
+		refs:      make(map[string]int),
+		advertise: s.Advertise,
+		withdraw:  s.Withdraw,
+		underlay:  s.coversUnderlay,
+	}
+
+	if im.table == 0 {
+		im.table = unix.RT_TABLE_MAIN
+	}
+
+	for _, name := range c.Interfaces {
+		im.ifaces[name] = true
+	}
+
+	return im
+}
+
+// importRoutes watches the kernel routes by netlink subscription
+// once the import table or interfaces are configured
+func (s *Server) importRoutes(ctx context.Context) {
+	c := s.Config.Routing.Import
+	if c.Table == 0 && len(c.Interfaces) == 0 {
+		return
+	}
+
+	im := s.newImporter()
+
+	ch := make(chan netlink.RouteUpdate, maxChanSize)
+	done := make(chan struct{})
+	defer close(done)
+
+	// subscribes before listing to not miss any change
+	if err := netlink.RouteSubscribe(ch, done); err != nil {
+		log.Println("route import:", err)
+		return
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+		&netlink.Route{Table: im.table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.Println("route import:", err)
+		return
+	}
+
+	for _, route := range routes {
+		im.update(route, linkName(route.LinkIndex), true)
+	}
+
+	for {
+		select {
+		case u, ok := <-ch:
+			if !ok {
+				log.Println("route import: subscription closed")
+				return
+			}
+			im.update(u.Route, linkName(u.LinkIndex), u.Type == unix.RTM_NEWROUTE)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// importable reports whether the kernel route should be advertised
+func (im *importer) importable(route netlink.Route, ifname string) bool {
+	if route.Dst == nil || route.Table != im.table || route.Type != unix.RTN_UNICAST {
+		return false
+	}
+
+	// the tunnel routes are the mesh routes and the radvpn routes
+	// like the underlay exclusions are never advertised
+	if ifname == "radvpn" || route.Protocol == router.Protocol {
+		return false
+	}
+
+	if route.Dst.IP.IsLinkLocalUnicast() || route.Dst.IP.IsLoopback() {
+		return false
+	}
+
+	if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+		return false
+	}
+
+	// e.g. the uplink's connected route, the tunnel
+	// packets would loop into the tunnel by its route
+	if im.underlay != nil && im.underlay(route.Dst) {
+		return false
+	}
+
+	return len(im.ifaces) == 0 || im.ifaces[ifname]
+}
+
+// update advertises a new imported prefix and withdraws the prefix
+// once the last kernel route of the prefix has been deleted, a deleted
+// route is found by the imported routes as its interface may be gone
+func (im *importer) update(route netlink.Route, ifname string, add bool) {
+	if route.Dst == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%s %d %d", route.Dst, route.LinkIndex, route.Priority)
+	prefix := route.Dst.String()
+
+	if add {
+		if !im.importable(route, ifname) {
+			return
+		}
+
+		if _, ok := im.routes[key]; ok {
+			return
+		}
+
+		im.routes[key] = prefix
+		im.refs[prefix]++
+		if im.refs[prefix] > 1 {
+			return
+		}
+
+		if err := im.advertise(config.Subnet{Prefix: prefix, Metric: im.metric}); err != nil {
+			log.Println("route import:", err)
+		}
+
+		return
+	}
+
+	if _, ok := im.routes[key]; !ok {
+		return
+	}
+
+	delete(im.routes, key)
+	im.refs[prefix]--
+	if im.refs[prefix] > 0 {
+		return
+	}
+
+	delete(im.refs, prefix)
+
+	if err := im.withdraw(prefix); err != nil {
+		log.Println("route import:", err)
+	}
+}
+
+// linkName returns the interface name of the index
+func linkName(index int) string {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return ""
+	}
+
+	return link.Attrs().Name
+}
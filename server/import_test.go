@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+func TestImporter(t *testing.T) {
+	advertised := map[string]bool{}
+
+	im := &importer{
+		table:  unix.RT_TABLE_MAIN,
+		ifaces: map[string]bool{"cni0": true},
+		routes: make(map[string]string),
+		refs:   make(map[string]int),
+		advertise: func(subnet config.Subnet) error {
+			advertised[subnet.Prefix] = true
+			return nil
+		},
+		withdraw: func(prefix string) error {
+			delete(advertised, prefix)
+			return nil
+		},
+		underlay: func(dst *net.IPNet) bool {
+			return dst.Contains(net.ParseIP("192.168.2.20"))
+		},
+	}
+
+	route := func(prefix string, index int) netlink.Route {
+		_, dst, _ := net.ParseCIDR(prefix)
+		return netlink.Route{
+			Dst:       dst,
+			LinkIndex: index,
+			Table:     unix.RT_TABLE_MAIN,
+			Type:      unix.RTN_UNICAST,
+		}
+	}
+
+	im.update(route("10.244.1.0/24", 3), "cni0", true)
+	im.update(route("10.244.1.0/24", 4), "cni0", true)
+	im.update(route("10.0.1.0/24", 5), "radvpn", true)
+	im.update(route("192.168.1.0/24", 2), "eth0", true)
+	// the uplink's connected route of a node endpoint
+	im.update(route("192.168.2.0/24", 3), "cni0", true)
+	im.update(route("0.0.0.0/0", 3), "cni0", true)
+
+	// an underlay exclusion through the uplink
+	exclusion := route("8.121.55.10/32", 3)
+	exclusion.Protocol = router.Protocol
+	im.update(exclusion, "cni0", true)
+
+	if len(advertised) != 1 || !advertised["10.244.1.0/24"] {
+		t.Fatal("expected 10.244.1.0/24 but got,", advertised)
+	}
+
+	// the prefix is still reachable by the other route
+	im.update(route("10.244.1.0/24", 3), "cni0", false)
+	if !advertised["10.244.1.0/24"] {
+		t.Error("expected 10.244.1.0/24 but withdrawn")
+	}
+
+	// the interface is already gone
+	im.update(route("10.244.1.0/24", 4), "", false)
+	if len(advertised) != 0 {
+		t.Error("expected withdrawn prefix but got,", advertised)
+	}
+
+	other := route("10.244.2.0/24", 3)
+	other.Table = 100
+	im.update(other, "cni0", true)
+	if len(advertised) != 0 {
+		t.Error("expected no prefix from the other table but got,", advertised)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// peer states, a new peer is at init state until it's heard
+// or detected as down, the routes are only withdrawn at down state
+const (
+	peerInit int32 = iota
+	peerUp
+	peerDown
+)
+
+var peerStates = map[int32]string{
+	peerInit: "init",
+	peerUp:   "up",
+	peerDown: "down",
+}
+
+// control messages are carried encrypted as the data messages
+// payload, they're distinguished from the ip packets by the
+// version nibble which is zero. the probe layout:
+//
+//	+--------+--------+--------+--------+
+//	|  type  |        timestamp         |
+//	+--------+                          +
+//	|                                   |
+//	+--------+--------+--------+--------+
+const (
+	ctrlProbe byte = iota + 1
+	ctrlProbeReply
+	ctrlRouteAdvertise
+	ctrlRouteWithdraw
+)
+
+const ctrlProbeSize = 1 + timestampSize
+
+// isControl reports whether the payload is a control message
+func isControl(b []byte) bool {
+	return len(b) > 0 && b[0]>>4 == 0
+}
+
+// detection returns the probe interval and the detection time, the
+// detection tx interval in milliseconds takes precedence over the keepalive
+func (s *Server) detection() (time.Duration, time.Duration) {
+	interval := time.Duration(s.Config.Server.Keepalive) * time.Second
+	if s.Config.Detection.TxInterval > 0 {
+		interval = time.Duration(s.Config.Detection.TxInterval) * time.Millisecond
+	}
+
+	multiplier := s.Config.Detection.Multiplier
+	if multiplier < 1 {
+		multiplier = 3
+	}
+
+	return interval, time.Duration(multiplier) * interval
+}
+
+// keepalive probes the peers every interval and marks the peers
+// which haven't been heard during the detection time down (BFD-like)
+func (s *Server) keepalive(ctx context.Context, conn net.PacketConn) {
+	interval, detect := s.detection()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		s.detect(conn, detect)
+	}
+}
+
+// detect probes the peers and marks the peers down which haven't
+// been heard during the detection time, a peer behind a relay
+// follows the relay state and a peer which isn't up is punched.
+// a down peer falls back to the relay server and a relayed peer
+// is probed directly as well to upgrade it once it's reachable
+func (s *Server) detect(conn net.PacketConn, detect time.Duration) {
+	s.register(conn)
+
+	for _, p := range s.peers.all() {
+		if relay := s.relay(p); relay != nil {
+			if state := relay.getState(); state != peerInit {
+				s.setPeerState(p, state)
+			}
+			continue
+		}
+
+		// keeps punching through the endpoints until the peer is heard
+		if p.getState() != peerUp {
+			p.nextEndpoint()
+			s.punch(conn, p.endpoint())
+		}
+
+		s.probe(conn, p, p.endpoint())
+
+		if p.isRelayed() {
+			s.punch(conn, p.direct())
+			s.probe(conn, p, p.direct())
+		}
+
+		// the other endpoints are probed to fail over once the current
+		// one isn't heard and to fail back to a preferred one
+		for _, addr := range p.alternates() {
+			s.probe(conn, p, addr)
+		}
+
+		if p.lastSeen() < time.Now().Add(-detect).UnixNano() {
+			s.setPeerState(p, peerDown)
+			s.fallback(p)
+		}
+	}
+}
+
+// probe sends a keepalive probe to the peer address
+func (s *Server) probe(conn net.PacketConn, p *peer, addr net.Addr) {
+	b := make([]byte, ctrlProbeSize)
+	b[0] = ctrlProbe
+	binary.BigEndian.PutUint64(b[1:], uint64(time.Now().UnixNano()))
+
+	b, err := s.seal(conn, p, b)
+	if err != nil {
+		if err != errNoSession {
+			log.Println(err)
+		}
+		return
+	}
+
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		log.Println(err)
+	}
+}
+
+// control handles the control message from the peer address
+func (s *Server) control(conn net.PacketConn, addr net.Addr, p *peer, b []byte) error {
+	switch b[0] {
+	case ctrlProbe, ctrlProbeReply:
+		return s.controlProbe(conn, addr, p, b)
+	case ctrlRouteAdvertise, ctrlRouteWithdraw:
+		return s.learn(p, b)
+	}
+
+	return errors.New("unknown control message")
+}
+
+// controlProbe replies to the probe by the way it came and
+// records the reply round-trip time
+func (s *Server) controlProbe(conn net.PacketConn, addr net.Addr, p *peer, b []byte) error {
+	if len(b) < ctrlProbeSize {
+		return errShortPacket
+	}
+
+	switch b[0] {
+	case ctrlProbe:
+		reply := make([]byte, ctrlProbeSize)
+		reply[0] = ctrlProbeReply
+		copy(reply[1:], b[1:ctrlProbeSize])
+
+		reply, err := s.seal(conn, p, reply)
+		if err != nil {
+			if err == errNoSession {
+				return nil
+			}
+			return err
+		}
+
+		_, err = conn.WriteTo(reply, addr)
+
+		return err
+	case ctrlProbeReply:
+		sent := int64(binary.BigEndian.Uint64(b[1:]))
+		atomic.StoreInt64(&p.rtt, time.Now().UnixNano()-sent)
+	}
+
+	return nil
+}
+
+// alive records that the peer has been heard and marks it up
+func (s *Server) alive(p *peer) {
+	atomic.StoreInt64(&p.seen, time.Now().UnixNano())
+	s.setPeerState(p, peerUp)
+}
+
+// setPeerState changes the peer state, the routes through
+// a down peer are skipped by the router
+func (s *Server) setPeerState(p *peer, state int32) {
+	old := atomic.LoadInt32(&p.state)
+	if old == state || !atomic.CompareAndSwapInt32(&p.state, old, state) {
+		return
+	}
+
+	atomic.StoreInt64(&p.changed, time.Now().UnixNano())
+
+	node := p.getNode()
+	log.Printf("node %s is %s", node.Name, peerStates[state])
+
+	if s.Router != nil && (state == peerDown || old == peerDown) {
+		s.Router.Table().SetDown(net.ParseIP(node.Address), state == peerDown)
+	}
+}
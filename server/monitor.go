@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/config"
+)
+
+// PeerStatus represents the monitoring state of a peer
+type PeerStatus struct {
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Endpoint string    `json:"endpoint"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastSeen"`
+	RTT      float64   `json:"rttMs"`
+	Session  bool      `json:"session"`
+	Replayed uint64    `json:"replayed"`
+}
+
+// Status returns the state of the peers sorted by name
+func (s *Server) Status() []PeerStatus {
+	var status []PeerStatus
+
+	for _, p := range s.peers.all() {
+		node := p.getNode()
+		ps := PeerStatus{
+			Name:     node.Name,
+			Address:  node.Address,
+			Endpoint: p.endpoint().String(),
+			State:    peerStates[p.getState()],
+			LastSeen: time.Unix(0, p.lastSeen()),
+			RTT:      float64(atomic.LoadInt64(&p.rtt)) / float64(time.Millisecond),
+			Session:  p.session() != nil,
+			Replayed: atomic.LoadUint64(&p.replayed),
+		}
+
+		if changed := atomic.LoadInt64(&p.changed); changed != 0 {
+			ps.Since = time.Unix(0, changed)
+		}
+
+		status = append(status, ps)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
+
+// LearnedRoute represents a route learned from a node
+type LearnedRoute struct {
+	Prefix  string    `json:"prefix"`
+	NextHop string    `json:"nexthop"`
+	Weight  int       `json:"weight"`
+	Metric  int       `json:"metric"`
+	Expires time.Time `json:"expires"`
+}
+
+// RoutesStatus represents the advertised and the learned routes
+type RoutesStatus struct {
+	Advertised []config.Subnet `json:"advertised"`
+	Learned    []LearnedRoute  `json:"learned"`
+}
+
+// Routes returns the advertised and the learned routes
+func (s *Server) Routes() RoutesStatus {
+	status := RoutesStatus{
+		Advertised: s.adverts.advertised(),
+		Learned:    []LearnedRoute{},
+	}
+
+	s.adverts.Lock()
+	for _, learned := range s.adverts.learned {
+		status.Learned = append(status.Learned, LearnedRoute{
+			Prefix:  learned.route.NetworkID.String(),
+			NextHop: learned.route.NextHop.IP.String(),
+			Weight:  learned.route.NextHop.Weight,
+			Metric:  learned.route.Metric,
+			Expires: learned.expires,
+		})
+	}
+	s.adverts.Unlock()
+
+	sort.Slice(status.Learned, func(i, j int) bool {
+		a, b := status.Learned[i], status.Learned[j]
+		return a.Prefix < b.Prefix || a.Prefix == b.Prefix && a.NextHop < b.NextHop
+	})
+
+	return status
+}
+
+// routesHandler lists the routes
+func (s *Server) routesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Routes())
+}
+
+// controlRoutesHandler lists the routes, advertises a subnet by
+// POST {"prefix": ..., "weight": ..., "metric": ...} and
+// withdraws a subnet by DELETE ?prefix=
+func (s *Server) controlRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var subnet config.Subnet
+		if err = json.NewDecoder(r.Body).Decode(&subnet); err == nil {
+			err = s.Advertise(subnet)
+		}
+	case http.MethodDelete:
+		err = s.Withdraw(r.URL.Query().Get("prefix"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Routes())
+}
+
+// monitor serves the peers state as json at /peers and the routes
+// at /routes once the monitor address is configured
+func (s *Server) monitor(ctx context.Context) {
+	if s.Config.Monitor.Address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+	mux.HandleFunc("/routes", s.routesHandler)
+
+	srv := &http.Server{Addr: s.Config.Monitor.Address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+}
+
+// controlSocket serves the routes write api at /routes on the unix
+// socket once it's configured, the socket is only accessible by the
+// owner and the monitor stays read only
+func (s *Server) controlSocket(ctx context.Context) {
+	path := s.Config.Control.Socket
+	if path == "" {
+		return
+	}
+
+	// the socket of a previous run
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		log.Println(err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", s.controlRoutesHandler)
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+}
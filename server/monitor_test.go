@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutesHandler(t *testing.T) {
+	s, _ := testHandshakeServers(t)
+
+	w := httptest.NewRecorder()
+	s.routesHandler(w, httptest.NewRequest(http.MethodPost, "/routes",
+		strings.NewReader(`{"prefix": "0.0.0.0/0"}`)))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("expected method not allowed but got,", w.Code)
+	}
+
+	if len(s.adverts.advertised()) != 0 {
+		t.Error("expected no advertised subnet but got,", s.adverts.advertised())
+	}
+
+	w = httptest.NewRecorder()
+	s.routesHandler(w, httptest.NewRequest(http.MethodGet, "/routes", nil))
+	if w.Code != http.StatusOK {
+		t.Error("expected ok but got,", w.Code)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _ := testHandshakeServers(t)
+	s.Config.Control.Socket = filepath.Join(dir, "radvpn.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.controlSocket(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", s.Config.Control.Socket)
+		},
+	}}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Post("http://radvpn/routes", "application/json",
+			strings.NewReader(`{"prefix": "172.17.0.0/16"}`))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("expected ok but got,", resp.StatusCode)
+	}
+
+	if subnets := s.adverts.advertised(); len(subnets) != 1 || subnets[0].Prefix != "172.17.0.0/16" {
+		t.Error("expected 172.17.0.0/16 but got,", subnets)
+	}
+
+	if info, err := os.Stat(s.Config.Control.Socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("expected the socket mode 0600 but got,", info, err)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// packet layout, all the messages share the header
+//
+//	0        8        16       24       32
+//	+--------+--------+--------+--------+
+//	|version |  type  | flags  |reserved|
+//	+--------+--------+--------+--------+
+//	|            session id             |
+//	+--------+--------+--------+--------+
+//	|           message body            |
+//	+-----------------------------------+
+//
+// the session id is the sender's index at the handshake initiation and
+// the receiver's index at the other messages
+const (
+	protoVersion = 1
+
+	msgHeaderSize = 8
+)
+
+// message types
+const (
+	msgHandshakeInit byte = iota + 1
+	msgHandshakeResp
+	msgData
+	// msgVersion carries the protocol version of the sender,
+	// it's accepted at any version
+	msgVersion
+	// msgPunch opens the nat mapping toward a peer, it has no body
+	// and it's not authenticated
+	msgPunch
+	// msgRelay carries an opaque message through the relay server
+	msgRelay
+)
+
+const (
+	indexSize   = 4
+	counterSize = 8
+
+	handshakeInitHdrSize = msgHeaderSize
+	// header + sender index
+	handshakeRespHdrSize = msgHeaderSize + indexSize
+	// header + counter
+	dataHdrSize = msgHeaderSize + counterSize
+)
+
+var errShortPacket = errors.New("small packet")
+
+// msgHeader represents the common header of the messages
+type msgHeader struct {
+	version byte
+	typ     byte
+	flags   byte
+	session uint32
+}
+
+// errVersion represents a packet from a peer with a different protocol
+type errVersion struct {
+	version byte
+	addr    string
+}
+
+func (e errVersion) Error() string {
+	if e.version < protoVersion {
+		return fmt.Sprintf("unsupported protocol version %d from %s, the peer may run an older radvpn",
+			e.version, e.addr)
+	}
+
+	return fmt.Sprintf("unsupported protocol version %d from %s, the peer may run a newer radvpn",
+		e.version, e.addr)
+}
+
+func (h msgHeader) marshal(b []byte) {
+	b[0] = h.version
+	b[1] = h.typ
+	b[2] = h.flags
+	b[3] = 0
+	binary.BigEndian.PutUint32(b[4:], h.session)
+}
+
+// parseMsgHeader decodes and validates the header, the packets
+// from a peer with another version return errVersion
+func parseMsgHeader(b []byte, addr string) (msgHeader, error) {
+	if len(b) < msgHeaderSize {
+		return msgHeader{}, errShortPacket
+	}
+
+	h := msgHeader{
+		version: b[0],
+		typ:     b[1],
+		flags:   b[2],
+		session: binary.BigEndian.Uint32(b[4:]),
+	}
+
+	if h.typ == msgVersion {
+		return h, nil
+	}
+
+	if h.version != protoVersion || b[3] != 0 {
+		return h, errVersion{h.version, addr}
+	}
+
+	return h, nil
+}
+
+func newMsg(typ byte, session uint32, hdrSize int, body []byte) []byte {
+	b := make([]byte, hdrSize+len(body))
+	msgHeader{
+		version: protoVersion,
+		typ:     typ,
+		session: session,
+	}.marshal(b)
+	copy(b[hdrSize:], body)
+
+	return b
+}
+
+func marshalHandshakeInit(sender uint32, msg []byte) []byte {
+	return newMsg(msgHandshakeInit, sender, handshakeInitHdrSize, msg)
+}
+
+func marshalHandshakeResp(sender, receiver uint32, msg []byte) []byte {
+	b := newMsg(msgHandshakeResp, receiver, handshakeRespHdrSize, msg)
+	binary.BigEndian.PutUint32(b[msgHeaderSize:], sender)
+
+	return b
+}
+
+func marshalData(receiver uint32, counter uint64, payload []byte) []byte {
+	b := newMsg(msgData, receiver, dataHdrSize, payload)
+	binary.BigEndian.PutUint64(b[msgHeaderSize:], counter)
+
+	return b
+}
+
+func unmarshalData(b []byte) (uint32, uint64, []byte, error) {
+	if len(b) < dataHdrSize {
+		return 0, 0, nil, errShortPacket
+	}
+
+	receiver := binary.BigEndian.Uint32(b[4:])
+	counter := binary.BigEndian.Uint64(b[msgHeaderSize:])
+
+	return receiver, counter, b[dataHdrSize:], nil
+}
+
+func marshalPunch() []byte {
+	return newMsg(msgPunch, 0, msgHeaderSize, nil)
+}
+
+// relay message layout, the relay server forwards the message
+// to the destination node and it never decrypts the inner message.
+// a message without destination registers the source node
+//
+//	+--------+--------+--------+--------+
+//	|              header               |
+//	+--------+--------+--------+--------+
+//	|dst len |  destination node name   |
+//	+--------+--------------------------+
+//	|src len |     source node name     |
+//	+--------+--------------------------+
+//	|           inner message           |
+//	+-----------------------------------+
+func marshalRelay(dst, src string, inner []byte) []byte {
+	body := make([]byte, 0, 2+len(dst)+len(src)+len(inner))
+	body = append(body, byte(len(dst)))
+	body = append(body, dst...)
+	body = append(body, byte(len(src)))
+	body = append(body, src...)
+	body = append(body, inner...)
+
+	return newMsg(msgRelay, 0, msgHeaderSize, body)
+}
+
+func unmarshalRelay(b []byte) (string, string, []byte, error) {
+	if len(b) < msgHeaderSize+2 {
+		return "", "", nil, errShortPacket
+	}
+
+	b = b[msgHeaderSize:]
+
+	n := int(b[0])
+	if len(b) < 1+n+1 {
+		return "", "", nil, errShortPacket
+	}
+	dst := string(b[1 : 1+n])
+	b = b[1+n:]
+
+	n = int(b[0])
+	if len(b) < 1+n {
+		return "", "", nil, errShortPacket
+	}
+	src := string(b[1 : 1+n])
+
+	return dst, src, b[1+n:], nil
+}
+
+func marshalVersion() []byte {
+	return newMsg(msgVersion, 0, msgHeaderSize, nil)
+}
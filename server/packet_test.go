@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseMsgHeader(t *testing.T) {
+	b := marshalData(0x01020304, 7, []byte("vpn"))
+
+	h, err := parseMsgHeader(b, "192.168.55.10:8085")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if h.version != protoVersion {
+		t.Errorf("expected version %d but got, %d", protoVersion, h.version)
+	}
+
+	if h.typ != msgData {
+		t.Errorf("expected type %d but got, %d", msgData, h.typ)
+	}
+
+	if h.session != 0x01020304 {
+		t.Errorf("expected session 0x01020304 but got, %#x", h.session)
+	}
+
+	receiver, counter, payload, err := unmarshalData(b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if receiver != 0x01020304 || counter != 7 || string(payload) != "vpn" {
+		t.Error("unexpected data message", receiver, counter, string(payload))
+	}
+
+	if _, err := parseMsgHeader(b[:4], ""); err != errShortPacket {
+		t.Error("expected small packet error but got,", err)
+	}
+}
+
+func TestParseMsgHeaderVersion(t *testing.T) {
+	b := marshalData(1, 1, nil)
+	b[0] = protoVersion + 1
+
+	_, err := parseMsgHeader(b, "192.168.55.10:8085")
+	if _, ok := err.(errVersion); !ok {
+		t.Error("expected version error but got,", err)
+	}
+
+	// version message is accepted at any version
+	b = marshalVersion()
+	b[0] = protoVersion + 1
+
+	h, err := parseMsgHeader(b, "192.168.55.10:8085")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if h.version != protoVersion+1 {
+		t.Error("expected the peer version but got,", h.version)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	s := &Server{}
+	c := &testConn{}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+
+	// a packet without header from an older peer
+	b := []byte{0xaf, 0x3b, 0x11, 0x9e, 0x2c, 0x71, 0x05, 0xd2, 0x10}
+
+	if _, err := s.handle(c, addr, b); err == nil {
+		t.Fatal("expected version error but got nil")
+	}
+
+	if len(c.out) != 1 || c.out[0][1] != msgVersion {
+		t.Fatal("expected version reply")
+	}
+
+	// rate limited
+	s.handle(c, addr, b)
+	if len(c.out) != 1 {
+		t.Error("expected one version reply but got,", len(c.out))
+	}
+}
@@ -0,0 +1,676 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/crypto"
+)
+
+// rekeyTimeout is the time to wait for a handshake response
+// before a new handshake can be initiated
+const rekeyTimeout = 5 * time.Second
+
+// session holds the transport ciphers of a completed handshake,
+// the shared key mode uses a session with zero indexes
+type session struct {
+	// last sent counter, accessed atomically
+	counter uint64
+	// retirement time in unix nano, accessed atomically
+	retired int64
+
+	local  uint32
+	remote uint32
+
+	tx crypto.Cipher
+	rx crypto.Cipher
+
+	created time.Time
+	// a new shared key session starts to send after the overlap
+	txAfter time.Time
+	// the shared key counter doesn't fall behind the time more than lag
+	lag time.Duration
+	// the handshake is initiated by the node with the lower public key,
+	// it wins over a crossing handshake from the other node
+	preferred bool
+
+	replay replayFilter
+
+	peer *peer
+}
+
+// peer represents a remote node
+type peer struct {
+	// rejected replayed packets, accessed atomically
+	replayed uint64
+	// last authenticated packet in unix nano, accessed atomically
+	seen int64
+	// last keepalive round-trip time in nanoseconds, accessed atomically
+	rtt int64
+	// last state change in unix nano, accessed atomically
+	changed int64
+	// last punch reply in unix nano, accessed atomically
+	punched int64
+	// peer state, accessed atomically
+	state int32
+
+	sync.Mutex
+
+	node config.Node
+	// the current endpoint, it's learned from the authenticated
+	// packets once the peer is behind a nat or roams
+	addr      *net.UDPAddr
+	endpoints []*nodeEndpoint
+	// the relay server once the peer can't be reached directly
+	relayed   *net.UDPAddr
+	publicKey crypto.PublicKey
+
+	current  *session
+	previous *session
+
+	handshake *crypto.Handshake
+	hsIndex   uint32
+	hsTime    time.Time
+	timestamp uint64
+}
+
+// nodeEndpoint represents a configured endpoint of the peer
+type nodeEndpoint struct {
+	addr     *net.UDPAddr
+	priority int
+	// last authenticated packet from the endpoint ip in unix nano
+	seen int64
+}
+
+// peers represents the remote nodes and their sessions
+type peers struct {
+	sync.RWMutex
+
+	byAddr     map[string]*peer
+	byEndpoint map[string]*peer
+	// an ip which is shared by several nodes, e.g. behind
+	// the same nat, belongs to none of them (nil)
+	byIP       map[string]*peer
+	byName     map[string]*peer
+	byKey      map[crypto.PublicKey]*peer
+	sessions   map[uint32]*session
+	handshakes map[uint32]*peer
+}
+
+func newPeers() *peers {
+	return &peers{
+		byAddr:     make(map[string]*peer),
+		byEndpoint: make(map[string]*peer),
+		byIP:       make(map[string]*peer),
+		byName:     make(map[string]*peer),
+		byKey:      make(map[crypto.PublicKey]*peer),
+		sessions:   make(map[uint32]*session),
+		handshakes: make(map[uint32]*peer),
+	}
+}
+
+// update syncs the peers with the configured nodes except the local node,
+// the cipher is the shared key cipher and it's nil at handshake mode which
+// the nodes without public key are left out. the port is the endpoint's port
+// or the local port, a learned endpoint is kept until the endpoints change
+func (ps *peers) update(cfg *config.Config, self config.Node, port string, cipher crypto.Cipher) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	overlap := time.Duration(cfg.Crypto.RekeyOverlap) * time.Second
+	byAddr := make(map[string]*peer)
+	byEndpoint := make(map[string]*peer)
+	byIP := make(map[string]*peer)
+	byName := make(map[string]*peer)
+	byKey := make(map[crypto.PublicKey]*peer)
+
+	for _, nodes := range cfg.Nodes {
+		node := nodes.Node
+		if node.Name == self.Name {
+			continue
+		}
+
+		if cipher == nil && !cfg.Server.Insecure && node.PublicKey == "" {
+			log.Printf("node %s: no public key, ignored", node.Name)
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+		if node.PublicKey != "" {
+			var err error
+			publicKey, err = crypto.ParsePublicKey(node.PublicKey)
+			if err != nil {
+				log.Printf("node %s: %v", node.Name, err)
+				continue
+			}
+		}
+
+		endpoints, err := resolveEndpoints(node, port)
+		if err != nil {
+			log.Printf("node %s: %v", node.Name, err)
+			continue
+		}
+
+		p, ok := ps.byAddr[node.Address]
+		if !ok || p.publicKey != publicKey {
+			p = &peer{publicKey: publicKey, seen: time.Now().UnixNano()}
+		}
+
+		p.Lock()
+		p.node = node
+		if !sameEndpoints(p.endpoints, endpoints) {
+			p.endpoints = endpoints
+			p.addr = endpoints[0].addr
+		}
+		if cipher != nil && (p.current == nil || p.current.tx != cipher) {
+			p.rotate(cipher, overlap)
+		}
+		p.Unlock()
+
+		byAddr[node.Address] = p
+		addUnique(byIP, node.Address, p)
+		for _, e := range endpoints {
+			addUnique(byEndpoint, e.addr.String(), p)
+			addUnique(byIP, e.addr.IP.String(), p)
+		}
+		byName[node.Name] = p
+		if !publicKey.IsZero() {
+			byKey[publicKey] = p
+		}
+	}
+
+	for index, sess := range ps.sessions {
+		if byAddr[sess.peer.node.Address] != sess.peer {
+			delete(ps.sessions, index)
+		}
+	}
+
+	for index, p := range ps.handshakes {
+		if byAddr[p.node.Address] != p {
+			delete(ps.handshakes, index)
+		}
+	}
+
+	ps.byAddr = byAddr
+	ps.byEndpoint = byEndpoint
+	ps.byIP = byIP
+	ps.byName = byName
+	ps.byKey = byKey
+}
+
+// get returns the peer based on its address
+func (ps *peers) get(addr string) *peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.byAddr[addr]
+}
+
+// addUnique adds the peer by the key, a key of several peers
+// belongs to none of them
+func addUnique(m map[string]*peer, key string, p *peer) {
+	if other, ok := m[key]; ok && other != p {
+		m[key] = nil
+		return
+	}
+
+	m[key] = p
+}
+
+// getByEndpoint returns the peer based on one of its endpoints, an
+// address with another port belongs to the peer of its ip as the port
+// may be changed by a nat, unless the ip is shared by several peers
+func (ps *peers) getByEndpoint(addr *net.UDPAddr) *peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	if p, ok := ps.byEndpoint[addr.String()]; ok {
+		return p
+	}
+
+	return ps.byIP[addr.IP.String()]
+}
+
+// resolveEndpoints returns the node's endpoints by the priority,
+// the port is the default port
+func resolveEndpoints(node config.Node, port string) ([]*nodeEndpoint, error) {
+	var endpoints []*nodeEndpoint
+
+	for _, e := range node.GetEndpoints() {
+		endpointPort := port
+		if e.Port > 0 {
+			endpointPort = strconv.Itoa(e.Port)
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(e.Address, endpointPort))
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, &nodeEndpoint{addr: addr, priority: e.Priority})
+	}
+
+	return endpoints, nil
+}
+
+// sameEndpoints reports whether the endpoints are the same
+func sameEndpoints(a, b []*nodeEndpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].addr.String() != b[i].addr.String() || a[i].priority != b[i].priority {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getByName returns the peer based on its node name
+func (ps *peers) getByName(name string) *peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.byName[name]
+}
+
+// all returns the peers
+func (ps *peers) all() []*peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	all := make([]*peer, 0, len(ps.byAddr))
+	for _, p := range ps.byAddr {
+		all = append(all, p)
+	}
+
+	return all
+}
+
+// getByKey returns the peer based on its public key
+func (ps *peers) getByKey(key crypto.PublicKey) *peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.byKey[key]
+}
+
+// session returns the session based on the local index
+func (ps *peers) session(index uint32) *session {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.sessions[index]
+}
+
+// addHandshake registers a pending handshake and returns its index
+func (ps *peers) addHandshake(p *peer) uint32 {
+	ps.Lock()
+	defer ps.Unlock()
+
+	index := ps.newIndex()
+	ps.handshakes[index] = p
+
+	return index
+}
+
+// handshake returns the peer which initiated the handshake
+func (ps *peers) handshake(index uint32) *peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.handshakes[index]
+}
+
+// addSession registers the session, a session from an initiated
+// handshake keeps the handshake index otherwise gets a new index
+func (ps *peers) addSession(sess *session) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if sess.local == 0 {
+		sess.local = ps.newIndex()
+	}
+
+	delete(ps.handshakes, sess.local)
+	ps.sessions[sess.local] = sess
+}
+
+// del removes a session or a pending handshake
+func (ps *peers) del(index uint32) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	delete(ps.sessions, index)
+	delete(ps.handshakes, index)
+}
+
+// newIndex returns a random unused non-zero index
+func (ps *peers) newIndex() uint32 {
+	b := make([]byte, indexSize)
+
+	for {
+		rand.Read(b)
+		index := binary.BigEndian.Uint32(b)
+		if index == 0 {
+			continue
+		}
+
+		_, ok1 := ps.sessions[index]
+		_, ok2 := ps.handshakes[index]
+		if !ok1 && !ok2 {
+			return index
+		}
+	}
+}
+
+// endpoint returns the address of the peer, it's through
+// the relay server once the peer is relayed
+func (p *peer) endpoint() net.Addr {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.relayed != nil {
+		return &relayedAddr{server: p.relayed, name: p.node.Name}
+	}
+
+	return p.addr
+}
+
+// direct returns the udp address of the peer
+func (p *peer) direct() *net.UDPAddr {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.addr
+}
+
+// isRelayed reports whether the peer is reached through the relay server
+func (p *peer) isRelayed() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.relayed != nil
+}
+
+// setRelayed sets the relay server of the peer or nil to reach
+// it directly, it reports whether it's changed
+func (p *peer) setRelayed(server *net.UDPAddr) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if (p.relayed == nil) == (server == nil) {
+		return false
+	}
+
+	p.relayed = server
+
+	return true
+}
+
+// setEndpoint updates the endpoint of the peer by the source of an
+// authenticated packet (roaming), it reports whether it's changed. a
+// configured endpoint doesn't replace a preferred current endpoint
+// which has been heard after the stale time (unix nano)
+func (p *peer) setEndpoint(addr *net.UDPAddr, stale int64) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	e := p.endpointOf(addr)
+	if e != nil {
+		e.seen = time.Now().UnixNano()
+	}
+
+	if p.addr != nil && p.addr.IP.Equal(addr.IP) && p.addr.Port == addr.Port {
+		return false
+	}
+
+	if current := p.endpointOf(p.addr); e != nil && current != nil && e != current &&
+		e.priority >= current.priority && current.seen > stale {
+		return false
+	}
+
+	p.addr = addr
+
+	return true
+}
+
+// endpointOf returns the configured endpoint of the address, an
+// address with another port belongs to the only endpoint of its ip
+// as the port may be changed by a nat
+func (p *peer) endpointOf(addr *net.UDPAddr) *nodeEndpoint {
+	if addr == nil {
+		return nil
+	}
+
+	var match *nodeEndpoint
+	for _, e := range p.endpoints {
+		if !e.addr.IP.Equal(addr.IP) {
+			continue
+		}
+
+		if e.addr.Port == addr.Port {
+			return e
+		}
+
+		if match != nil {
+			return nil
+		}
+		match = e
+	}
+
+	return match
+}
+
+// isEndpoint reports whether the address is the current or
+// a configured endpoint of the peer
+func (p *peer) isEndpoint(addr *net.UDPAddr) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.addr != nil && p.addr.IP.Equal(addr.IP) && p.addr.Port == addr.Port {
+		return true
+	}
+
+	return p.endpointOf(addr) != nil
+}
+
+// alternates returns the configured endpoints except the current one
+func (p *peer) alternates() []*net.UDPAddr {
+	p.Lock()
+	defer p.Unlock()
+
+	current := p.endpointOf(p.addr)
+
+	var addrs []*net.UDPAddr
+	for _, e := range p.endpoints {
+		if e != current {
+			addrs = append(addrs, e.addr)
+		}
+	}
+
+	return addrs
+}
+
+// nextEndpoint moves to the next configured endpoint, so the
+// handshake is tried through all the endpoints of a peer which isn't up
+func (p *peer) nextEndpoint() {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.endpoints) < 2 {
+		return
+	}
+
+	next := 0
+	current := p.endpointOf(p.addr)
+	for i, e := range p.endpoints {
+		if e == current {
+			next = (i + 1) % len(p.endpoints)
+			break
+		}
+	}
+
+	p.addr = p.endpoints[next].addr
+}
+
+// endpointIPs returns the ips of the configured endpoints
+// and the learned endpoint
+func (p *peer) endpointIPs() []net.IP {
+	p.Lock()
+	defer p.Unlock()
+
+	var ips []net.IP
+	for _, e := range p.endpoints {
+		ips = append(ips, e.addr.IP)
+	}
+
+	if p.addr != nil && p.endpointOf(p.addr) == nil {
+		ips = append(ips, p.addr.IP)
+	}
+
+	return ips
+}
+
+// getNode returns the node of the peer
+func (p *peer) getNode() config.Node {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.node
+}
+
+// lastSeen returns the last time in unix nano that the peer has been heard
+func (p *peer) lastSeen() int64 {
+	return atomic.LoadInt64(&p.seen)
+}
+
+// getState returns the peer state
+func (p *peer) getState() int32 {
+	return atomic.LoadInt32(&p.state)
+}
+
+// session returns the current session
+func (p *peer) session() *session {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.current
+}
+
+// sessions returns the current and the previous sessions
+func (p *peer) sessions() (*session, *session) {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.current, p.previous
+}
+
+// txSession returns the session to encrypt with
+func (p *peer) txSession() *session {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current != nil && p.previous != nil && time.Now().Before(p.current.txAfter) {
+		return p.previous
+	}
+
+	return p.current
+}
+
+// setSession makes the session current and returns the expired one,
+// once both nodes initiate at the same time the session which isn't
+// preferred is expired right away so both nodes keep the same session
+func (p *peer) setSession(sess *session) *session {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current != nil && p.current.preferred && !sess.preferred &&
+		time.Since(p.current.created) < rekeyTimeout {
+		return sess
+	}
+
+	expired := p.previous
+	if p.current != nil {
+		p.current.retire(time.Now())
+	}
+
+	p.previous = p.current
+	p.current = sess
+
+	return expired
+}
+
+// rotate replaces the shared key session, the current session keeps
+// sending during the overlap so the other nodes can catch up the new key
+func (p *peer) rotate(cipher crypto.Cipher, overlap time.Duration) {
+	now := time.Now()
+	sess := &session{
+		tx:      cipher,
+		rx:      cipher,
+		created: now,
+		peer:    p,
+	}
+
+	// there is no handshake to reset the counters of the shared
+	// key, so the counter follows the time to keep it increasing
+	// once the node restarts. the receiver rejects the counters
+	// older than the overlap, so the packets which are captured
+	// before a restart can't be replayed. the clocks of the nodes
+	// can be apart up to half of the overlap
+	sess.counter = uint64(now.UnixNano())
+	sess.lag = overlap / 2
+	sess.replay.floor = uint64(now.Add(-overlap).UnixNano())
+
+	if p.current != nil {
+		sess.txAfter = now.Add(overlap)
+		p.current.retire(sess.txAfter)
+	}
+
+	p.previous = p.current
+	p.current = sess
+}
+
+// retire marks the session as replaced at the time
+func (sess *session) retire(t time.Time) {
+	atomic.StoreInt64(&sess.retired, t.UnixNano())
+}
+
+// expired reports whether the session has been retired longer than overlap
+func (sess *session) expired(overlap time.Duration) bool {
+	retired := atomic.LoadInt64(&sess.retired)
+	if retired == 0 {
+		return false
+	}
+
+	return time.Since(time.Unix(0, retired)) > overlap
+}
+
+// next returns the next counter to send, a shared key counter
+// jumps to the time once it falls behind more than the lag, so
+// the counters are consecutive between the jumps
+func (sess *session) next() uint64 {
+	counter := atomic.AddUint64(&sess.counter, 1)
+	if sess.lag == 0 {
+		return counter
+	}
+
+	now := time.Now()
+	for counter < uint64(now.Add(-sess.lag).UnixNano()) {
+		if atomic.CompareAndSwapUint64(&sess.counter, counter, uint64(now.UnixNano())) {
+			return uint64(now.UnixNano())
+		}
+		counter = atomic.AddUint64(&sess.counter, 1)
+	}
+
+	return counter
+}
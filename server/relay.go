@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayExpire is the time that a registered node is kept
+// by the relay server without any message from it
+const relayExpire = time.Minute
+
+// registration layout, it's the inner message of a relay message
+// without destination. the mac is hmac-sha256 by the relay token
+// of the source node name and the timestamp
+//
+//	+--------+--------+--------+--------+
+//	|          timestamp (8)            |
+//	+--------+--------+--------+--------+
+//	|             mac (32)              |
+//	+-----------------------------------+
+const registrationSize = timestampSize + sha256.Size
+
+var (
+	errNotRelayServer = errors.New("relayed message from unknown relay server")
+	errNoRelayToken   = errors.New("relay token is not configured")
+)
+
+// RelayServer forwards the encrypted messages between the nodes which
+// can't reach each other directly, e.g. behind symmetric nats (like
+// DERP / TURN). it doesn't have the nodes keys so it can't decrypt them.
+// the nodes register by the relay token and only the registered
+// address of a node can send through the relay
+type RelayServer struct {
+	Address string
+
+	token []byte
+
+	sync.RWMutex
+	endpoints map[string]relayEndpoint
+}
+
+type relayEndpoint struct {
+	addr      *net.UDPAddr
+	seen      time.Time
+	timestamp uint64
+}
+
+// NewRelayServer constructs a new relay server
+func NewRelayServer(address, token string) *RelayServer {
+	return &RelayServer{
+		Address:   address,
+		token:     []byte(token),
+		endpoints: make(map[string]relayEndpoint),
+	}
+}
+
+// Run listens and forwards the relayed messages until the context is done
+func (r *RelayServer) Run(ctx context.Context) error {
+	if len(r.token) == 0 {
+		return errNoRelayToken
+	}
+
+	conn, err := net.ListenPacket("udp", r.Address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(relayExpire)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.expire()
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	log.Println("relay address:", r.Address)
+
+	b := make([]byte, maxBufSize)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Println(err)
+			continue
+		}
+
+		if err := r.relay(conn, addr, b[:n]); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// relay registers the source node by the sender address once the
+// registration is authenticated and forwards the message from the
+// registered address to the destination node as it is
+func (r *RelayServer) relay(conn net.PacketConn, addr net.Addr, b []byte) error {
+	h, err := parseMsgHeader(b, addr.String())
+	if err != nil {
+		return err
+	}
+
+	if h.typ != msgRelay {
+		return fmt.Errorf("unexpected message type %d from %s", h.typ, addr)
+	}
+
+	dst, src, inner, err := unmarshalRelay(b)
+	if err != nil {
+		return err
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || src == "" {
+		return fmt.Errorf("relay from %s: unknown source", addr)
+	}
+
+	if dst == "" {
+		return r.register(udpAddr, src, inner)
+	}
+
+	now := time.Now()
+
+	r.Lock()
+	e, ok := r.endpoints[src]
+	if ok && e.addr.IP.Equal(udpAddr.IP) && e.addr.Port == udpAddr.Port {
+		e.seen = now
+		r.endpoints[src] = e
+	}
+	r.Unlock()
+
+	if !ok || !e.addr.IP.Equal(udpAddr.IP) || e.addr.Port != udpAddr.Port {
+		return fmt.Errorf("relay from %s: node %s is not registered by the address", addr, src)
+	}
+
+	r.RLock()
+	e, ok = r.endpoints[dst]
+	r.RUnlock()
+
+	if !ok || now.Sub(e.seen) > relayExpire {
+		return fmt.Errorf("relay from %s: node %s is not registered", src, dst)
+	}
+
+	_, err = conn.WriteTo(b, e.addr)
+
+	return err
+}
+
+// register verifies the registration of the node and keeps its address,
+// the timestamp should be newer than the last registration and within
+// the expiration so a captured registration can't be replayed
+func (r *RelayServer) register(addr *net.UDPAddr, name string, b []byte) error {
+	if len(b) != registrationSize {
+		return fmt.Errorf("relay registration from %s: invalid size", addr)
+	}
+
+	ts := binary.BigEndian.Uint64(b)
+	if !hmac.Equal(b[timestampSize:], registrationMAC(r.token, name, ts)) {
+		return fmt.Errorf("relay registration from %s: invalid mac", addr)
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, int64(ts))
+	if sent.Before(now.Add(-relayExpire)) || sent.After(now.Add(relayExpire)) {
+		return fmt.Errorf("relay registration from %s: invalid timestamp", addr)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if e, ok := r.endpoints[name]; ok && ts <= e.timestamp {
+		return fmt.Errorf("relay registration from %s: replayed registration", addr)
+	}
+
+	r.endpoints[name] = relayEndpoint{addr: addr, seen: now, timestamp: ts}
+
+	return nil
+}
+
+// registrationMAC returns the mac of the node name and the timestamp
+func registrationMAC(token []byte, name string, ts uint64) []byte {
+	b := make([]byte, timestampSize)
+	binary.BigEndian.PutUint64(b, ts)
+
+	mac := hmac.New(sha256.New, token)
+	mac.Write([]byte(name))
+	mac.Write(b)
+
+	return mac.Sum(nil)
+}
+
+// marshalRegistration returns the registration of the node
+func marshalRegistration(token []byte, name string) []byte {
+	ts := uint64(time.Now().UnixNano())
+
+	b := make([]byte, timestampSize, registrationSize)
+	binary.BigEndian.PutUint64(b, ts)
+
+	return marshalRelay("", name, append(b, registrationMAC(token, name, ts)...))
+}
+
+// expire removes the nodes which haven't been heard
+func (r *RelayServer) expire() {
+	r.Lock()
+	defer r.Unlock()
+
+	for name, e := range r.endpoints {
+		if time.Since(e.seen) > relayExpire {
+			delete(r.endpoints, name)
+		}
+	}
+}
+
+// relayedAddr is the address of a node through the relay server
+type relayedAddr struct {
+	server *net.UDPAddr
+	name   string
+}
+
+func (a *relayedAddr) Network() string { return "relay" }
+
+func (a *relayedAddr) String() string { return a.name + "@" + a.server.String() }
+
+// relayConn sends the messages to the relayed addresses through the relay server
+type relayConn struct {
+	net.PacketConn
+	name string
+}
+
+func (c *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*relayedAddr)
+	if !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+
+	if _, err := c.PacketConn.WriteTo(marshalRelay(a.name, c.name, b), a.server); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// handleRelay handles the inner message of a relayed message
+// from the relay server as a message from the source node
+func (s *Server) handleRelay(conn net.PacketConn, addr net.Addr, b []byte) ([]byte, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || s.relayServer == nil || !udpAddr.IP.Equal(s.relayServer.IP) || udpAddr.Port != s.relayServer.Port {
+		return nil, errNotRelayServer
+	}
+
+	_, src, inner, err := unmarshalRelay(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inner) > 1 && inner[1] == msgRelay {
+		return nil, fmt.Errorf("nested relay message from %s", src)
+	}
+
+	return s.handle(conn, &relayedAddr{server: udpAddr, name: src}, inner)
+}
+
+// register keeps the local node registered at the relay server,
+// it's sent every quarter of the expiration at most
+func (s *Server) register(conn net.PacketConn) {
+	if s.relayServer == nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.registered)
+	if now-last < int64(relayExpire/4) || !atomic.CompareAndSwapInt64(&s.registered, last, now) {
+		return
+	}
+
+	if _, err := conn.WriteTo(marshalRegistration(s.relayToken, s.node.Name), s.relayServer); err != nil {
+		log.Println(err)
+	}
+}
+
+// fallback sends the traffic of the peer through the relay
+// server once it can't be reached directly
+func (s *Server) fallback(p *peer) {
+	if s.relayServer == nil || !p.setRelayed(s.relayServer) {
+		return
+	}
+
+	log.Printf("node %s is relayed by %s", p.getNode().Name, s.relayServer)
+}
+
+// peerOf returns the peer of the address
+func (s *Server) peerOf(addr net.Addr) *peer {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return s.peers.getByEndpoint(a)
+	case *relayedAddr:
+		return s.peers.getByName(a.name)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMarshalRelay(t *testing.T) {
+	b := marshalRelay("node2", "node1", []byte("radvpn"))
+
+	dst, src, inner, err := unmarshalRelay(b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if dst != "node2" || src != "node1" || string(inner) != "radvpn" {
+		t.Error("expected node2, node1 and radvpn but got,", dst, src, string(inner))
+	}
+
+	if _, _, _, err := unmarshalRelay(b[:msgHeaderSize+3]); err != errShortPacket {
+		t.Error("expected short packet error but got,", err)
+	}
+}
+
+func TestRelayServer(t *testing.T) {
+	token := []byte("relay-token")
+	r := NewRelayServer(":8087", string(token))
+	c := &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40001}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 40002}
+	attacker := &net.UDPAddr{IP: net.ParseIP("192.0.2.66"), Port: 40066}
+
+	// the source isn't registered
+	if err := r.relay(c, addr1, marshalRelay("node2", "node1", []byte("secret"))); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	if err := r.relay(c, addr1, marshalRegistration(token, "node1")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the destination isn't registered
+	if err := r.relay(c, addr1, marshalRelay("node2", "node1", []byte("secret"))); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	registration := marshalRegistration(token, "node2")
+	if err := r.relay(c, addr2, registration); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the unauthenticated, the spoofed and the replayed registrations
+	for _, b := range [][]byte{
+		marshalRelay("", "node2", nil),
+		marshalRegistration([]byte("other-token"), "node2"),
+		registration,
+	} {
+		if err := r.relay(c, attacker, b); err == nil {
+			t.Error("expected error but got nil")
+		}
+	}
+
+	// a message by the name of a node from another address
+	if err := r.relay(c, attacker, marshalRelay("node2", "node1", []byte("secret"))); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	if len(c.out) != 0 {
+		t.Fatal("expected no forwarded message but got,", len(c.out))
+	}
+
+	b := marshalRelay("node2", "node1", []byte("secret"))
+	if err := r.relay(c, addr1, b); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(c.out) != 1 || c.addrs[0].String() != addr2.String() || string(c.out[0]) != string(b) {
+		t.Error("expected the message forwarded to", addr2, "but got,", c.addrs)
+	}
+
+	if err := r.relay(c, addr1, marshalPunch()); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestRelayFallback(t *testing.T) {
+	s1, s2 := testHandshakeServers(t)
+	relay := NewRelayServer(":8087", "relay-token")
+	relayAddr := &net.UDPAddr{IP: net.ParseIP("203.0.113.100"), Port: 8087}
+	s1.relayServer, s2.relayServer = relayAddr, relayAddr
+	s1.relayToken, s2.relayToken = []byte("relay-token"), []byte("relay-token")
+
+	addr1 := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40001}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 40002}
+
+	c1, c2, cr := &testConn{}, &testConn{}, &testConn{}
+	conn1 := &relayConn{PacketConn: c1, name: s1.node.Name}
+	conn2 := &relayConn{PacketConn: c2, name: s2.node.Name}
+
+	s1.register(conn1)
+	s2.register(conn2)
+	if err := relay.relay(cr, addr1, c1.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := relay.relay(cr, addr2, c2.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	p2 := s1.peers.get(s2.node.Address)
+	s1.fallback(p2)
+	if !p2.isRelayed() {
+		t.Fatal("expected relayed peer")
+	}
+
+	// the handshake through the relay server
+	s1.initiate(conn1, p2)
+	if c1.addrs[1].String() != relayAddr.String() {
+		t.Fatal("expected relay server address but got,", c1.addrs[1])
+	}
+
+	relay.relay(cr, addr1, c1.out[1])
+	if _, err := s2.handle(conn2, relayAddr, cr.out[0]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	p1 := s2.peers.get(s1.node.Address)
+	if !p1.isRelayed() {
+		t.Error("expected relayed peer")
+	}
+
+	relay.relay(cr, addr2, c2.out[1])
+	if _, err := s1.handle(conn1, relayAddr, cr.out[1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if p2.session() == nil {
+		t.Fatal("expected session")
+	}
+
+	// a relayed message only from the relay server
+	if _, err := s1.handle(conn1, addr2, cr.out[1]); err != errNotRelayServer {
+		t.Error("expected unknown relay server error but got,", err)
+	}
+
+	// the direct probe upgrades the peer
+	s1.probe(conn1, p2, p2.direct())
+	if _, err := s2.handle(conn2, addr1, c1.out[len(c1.out)-1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if p1.isRelayed() {
+		t.Error("expected direct peer")
+	}
+
+	if c2.addrs[len(c2.addrs)-1].String() != addr1.String() {
+		t.Error("expected the direct probe reply but got,", c2.addrs[len(c2.addrs)-1])
+	}
+}
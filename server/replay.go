@@ -0,0 +1,82 @@
+package server
+
+import "sync"
+
+const (
+	replayBlockBits = 64
+	replayBlocks    = 32
+	// replayWindow is the number of the counters behind the
+	// highest received counter which are tracked
+	replayWindow = (replayBlocks - 1) * replayBlockBits
+)
+
+// replayFilter represents the sliding window of the received counters
+// tools.ietf.org/html/rfc6479
+type replayFilter struct {
+	sync.Mutex
+
+	last   uint64
+	bitmap [replayBlocks]uint64
+	// the counters below are rejected, the shared key
+	// counters start from a time lower bound
+	floor uint64
+}
+
+// check reports whether the counter hasn't been seen yet and it's in
+// the window, it doesn't change the window
+func (r *replayFilter) check(counter uint64) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.valid(counter)
+}
+
+// update marks the counter as received and slides the window,
+// it returns false if the counter isn't acceptable
+func (r *replayFilter) update(counter uint64) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.valid(counter) {
+		return false
+	}
+
+	if counter > r.last {
+		current := r.last / replayBlockBits
+		index := counter / replayBlockBits
+
+		diff := index - current
+		if diff > replayBlocks {
+			diff = replayBlocks
+		}
+
+		for i := uint64(1); i <= diff; i++ {
+			r.bitmap[(current+i)%replayBlocks] = 0
+		}
+
+		r.last = counter
+	}
+
+	block := (counter / replayBlockBits) % replayBlocks
+	r.bitmap[block] |= 1 << (counter % replayBlockBits)
+
+	return true
+}
+
+func (r *replayFilter) valid(counter uint64) bool {
+	if counter < r.floor {
+		return false
+	}
+
+	if counter > r.last {
+		return true
+	}
+
+	if r.last-counter >= replayWindow {
+		return false
+	}
+
+	block := (counter / replayBlockBits) % replayBlocks
+
+	return r.bitmap[block]&(1<<(counter%replayBlockBits)) == 0
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mehrdadrad/radvpn/crypto"
+)
+
+func TestReplayFilter(t *testing.T) {
+	r := &replayFilter{}
+
+	for _, c := range []uint64{1, 2, 5, 3} {
+		if !r.update(c) {
+			t.Errorf("expected counter %d accepted", c)
+		}
+	}
+
+	for _, c := range []uint64{1, 2, 3, 5} {
+		if r.check(c) || r.update(c) {
+			t.Errorf("expected counter %d rejected", c)
+		}
+	}
+
+	if !r.check(4) {
+		t.Error("expected counter 4 accepted")
+	}
+
+	if !r.update(replayWindow + 10) {
+		t.Error("expected counter accepted")
+	}
+
+	// out of window
+	if r.update(4) {
+		t.Error("expected old counter rejected")
+	}
+
+	// in window, not seen
+	if !r.update(replayWindow) {
+		t.Error("expected counter in window accepted")
+	}
+
+	// big jump clears the window
+	if !r.update(1 << 40) {
+		t.Error("expected counter accepted")
+	}
+
+	if !r.update(1<<40 - 1) {
+		t.Error("expected counter in window accepted")
+	}
+
+	if r.update(1 << 40) {
+		t.Error("expected replayed counter rejected")
+	}
+}
+
+func TestSharedKeyCounter(t *testing.T) {
+	p := &peer{}
+	p.rotate(&crypto.GCM{}, 30*time.Second)
+	sess := p.session()
+
+	// a packet which is captured before the restart
+	old := uint64(time.Now().Add(-time.Minute).UnixNano())
+	if sess.replay.update(old) {
+		t.Error("expected old counter rejected")
+	}
+
+	if !sess.replay.update(uint64(time.Now().Add(-10 * time.Second).UnixNano())) {
+		t.Error("expected counter in the overlap accepted")
+	}
+
+	// the counter follows the time
+	before := uint64(time.Now().UnixNano())
+	atomic.StoreUint64(&sess.counter, old)
+	if counter := sess.next(); counter < before {
+		t.Error("expected the counter of the time but got,", counter)
+	}
+
+	if c1, c2 := sess.next(), sess.next(); c2 != c1+1 {
+		t.Error("expected increasing counters but got,", c1, c2)
+	}
+}
@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,12 +31,34 @@ const (
 
 // Server represents vpn server
 type Server struct {
-	Cipher crypto.Cipher
+	// last version reply in unix nano, accessed atomically
+	versionReplied int64
+	// last relay server registration in unix nano, accessed atomically
+	registered int64
+	// forwards the packets between the other nodes, accessed atomically
+	transit int32
+
 	Router router.Gateway
 	Config *config.Config
 	Notify chan struct{}
 
-	irb map[string][]string
+	irb map[string][]config.Subnet
+
+	node    config.Node
+	port    string
+	peers   *peers
+	adverts *adverts
+	nat     *masquerade
+	// the relay server which the unreachable peers fall back to
+	relayServer *net.UDPAddr
+	relayToken  []byte
+	// the shared key cipher, the sessions keep their ciphers
+	// so it's only accessed by the config watcher
+	cipher    crypto.Cipher
+	sharedKey string
+	// the handshake private key, it's nil at the shared key mode.
+	// it's replaced by the config watcher, accessed atomically
+	privateKey atomic.Value
 
 	read  chan []byte
 	write chan []byte
@@ -46,23 +73,50 @@ type tun struct {
 
 type header struct {
 	version int
+	proto   uint8
 	src     net.IP
 	dst     net.IP
+	srcPort uint16
+	dstPort uint16
 }
 
 // Run stars workers
-func (s Server) Run(ctx context.Context) {
+func (s *Server) Run(ctx context.Context) {
 	node, err := s.Config.Whoami()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	s.node = node
+
+	_, s.port, err = net.SplitHostPort(s.Config.Server.Address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if !s.Config.Server.Insecure {
 		if err := s.initCrypto(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	if s.Config.Relay.Address != "" {
+		s.relayServer, err = net.ResolveUDPAddr("udp", s.Config.Relay.Address)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		token, err := s.Config.GetRelayToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.relayToken = []byte(token)
+	}
+
+	s.peers = newPeers()
+	s.adverts = newAdverts()
+	s.updatePeers()
+
 	log.Println("address:", s.Config.Server.Address)
 
 	err = setupTunInterface(node.PrivateAddresses, s.Config.Server.Mtu)
@@ -70,6 +124,23 @@ func (s Server) Run(ctx context.Context) {
 		log.Fatal(err)
 	}
 
+	// the stale kernel routes, rules and exclusions of a previous
+	// run, the table is set first to find its routes and rules
+	s.Router.Table().SetTable(s.Config.Routing.Table)
+	if err := s.Router.Table().Cleanup(); err != nil {
+		log.Println(err)
+	}
+
+	if err := s.setPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := s.setupExit(); err != nil {
+		s.Cleanup()
+		log.Fatal(err)
+	}
+
+	s.updateUnderlay()
 	s.updateRoutes()
 	s.Router.Table().Dump()
 
@@ -85,30 +156,114 @@ func (s Server) Run(ctx context.Context) {
 
 	go t.run(ctx)
 	go s.run(ctx)
+	go s.monitor(ctx)
+	go s.controlSocket(ctx)
+	go s.importRoutes(ctx)
+	go s.reconciler(ctx)
 
 	s.cross(ctx, t)
 
 	s.watcher(ctx)
 }
 
+// initCrypto sets up the handshake private key once it's configured
+// otherwise the shared key cipher
 func (s *Server) initCrypto() error {
-	switch s.Config.Crypto.Type {
+	if s.Config.Crypto.PrivateKeyFile != "" {
+		key, err := crypto.ReadPrivateKeyFile(s.Config.Crypto.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+
+		publicKey, err := crypto.ParsePublicKey(s.node.PublicKey)
+		if err != nil || key.Public() != publicKey {
+			return fmt.Errorf("private key doesn't match the node %s public key", s.node.Name)
+		}
+
+		// validates the session cipher type
+		if _, err := crypto.NewCipher(s.Config.Crypto.Type, make([]byte, crypto.KeySize)); err != nil {
+			return err
+		}
+
+		// the readers load the key atomically, it's only
+		// replaced once the key or the mode has been changed
+		if current := s.key(); current == nil || *current != key {
+			s.setKey(&key)
+		}
+
+		s.cipher = nil
+		s.sharedKey = ""
+
+		return nil
+	}
+
+	key, err := s.Config.GetCryptoKey()
+	if err != nil {
+		return err
+	}
+
+	// keeps the current cipher, a new one means key rotation
+	c := s.Config.Crypto
+	sharedKey := strings.Join([]string{c.Type, c.KDF, c.Salt, key}, ":")
+	if s.cipher != nil && s.sharedKey == sharedKey {
+		return nil
+	}
+
+	var cipher crypto.Cipher
+
+	switch c.Type {
 	case "gcm":
-		s.Cipher = &crypto.GCM{
-			Passphrase: s.Config.Crypto.Key,
+		cipher = &crypto.GCM{
+			Passphrase: key,
+			KDF:        c.KDF,
+			Salt:       c.Salt,
 		}
-		s.Cipher.Init()
 	case "cbc":
-		s.Cipher = &crypto.CBC{
-			Passphrase: s.Config.Crypto.Key,
+		cipher = &crypto.CBC{
+			Passphrase: key,
+			KDF:        c.KDF,
+			Salt:       c.Salt,
+		}
+	case "chacha20":
+		cipher = &crypto.ChaCha20Poly1305{
+			Passphrase: key,
+			KDF:        c.KDF,
+			Salt:       c.Salt,
 		}
-		s.Cipher.Init()
 	default:
 		return errors.New("crypto not support")
 	}
+
+	if err := cipher.Init(); err != nil {
+		return fmt.Errorf("crypto key: %v", err)
+	}
+
+	s.cipher = cipher
+	s.sharedKey = sharedKey
+	if s.key() != nil {
+		s.setKey(nil)
+	}
+
 	return nil
 }
 
+// key returns the handshake private key or nil at the shared key mode
+func (s *Server) key() *crypto.PrivateKey {
+	key, _ := s.privateKey.Load().(*crypto.PrivateKey)
+	return key
+}
+
+// setKey replaces the handshake private key
+func (s *Server) setKey(key *crypto.PrivateKey) {
+	s.privateKey.Store(key)
+}
+
+// updatePeers syncs the peers with the configuration
+func (s *Server) updatePeers() {
+	s.peers.update(s.Config, s.node, s.port, s.cipher)
+	s.updateTransit()
+}
+
 func (s *Server) watcher(ctx context.Context) {
 	go func() {
 		for {
@@ -122,7 +277,15 @@ func (s *Server) watcher(ctx context.Context) {
 
 			s.updateRoutes()
 			if !s.Config.Server.Insecure {
-				s.initCrypto()
+				if err := s.initCrypto(); err != nil {
+					log.Println(err)
+				}
+			}
+			s.updatePeers()
+			s.updateUnderlay()
+
+			if err := s.setupExit(); err != nil {
+				log.Println(err)
 			}
 		}
 	}()
@@ -130,14 +293,21 @@ func (s *Server) watcher(ctx context.Context) {
 
 func (s *Server) run(ctx context.Context) {
 	for i := 0; i < s.Config.Server.MaxWorkers; i++ {
-		conn, err := s.listenPacket(ctx)
+		pc, err := s.listenPacket(ctx)
 		if err != nil {
 			log.Fatal(err)
 
 		}
 
+		conn := &relayConn{PacketConn: pc, name: s.node.Name}
+
 		go s.reader(ctx, conn)
 		go s.writer(ctx, conn)
+
+		if i == 0 {
+			go s.keepalive(ctx, conn)
+			go s.advertiser(ctx, conn)
+		}
 	}
 }
 
@@ -185,7 +355,6 @@ func (s Server) listenPacket(ctx context.Context) (net.PacketConn, error) {
 			}
 			return sockoptErr
 		},
-		KeepAlive: time.Duration(s.Config.Server.Keepalive) * time.Second,
 	}
 
 	return lc.ListenPacket(ctx, "udp", s.Config.Server.Address)
@@ -194,18 +363,24 @@ func (s Server) listenPacket(ctx context.Context) (net.PacketConn, error) {
 func (s *Server) reader(ctx context.Context, conn net.PacketConn) {
 	for {
 		b := make([]byte, maxBufSize)
-		n, _, err := conn.ReadFrom(b)
+		n, addr, err := conn.ReadFrom(b)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		if !s.Config.Server.Insecure {
-			b, err = s.Cipher.Decrypt(b[:n])
-			if err != nil {
+		b, err = s.handle(conn, addr, b[:n])
+		if err != nil {
+			// replayed packets are counted
+			if err != errReplay {
 				log.Println(err)
-				continue
 			}
+			continue
+		}
+
+		// control message
+		if b == nil {
+			continue
 		}
 
 		select {
@@ -218,11 +393,6 @@ func (s *Server) reader(ctx context.Context, conn net.PacketConn) {
 }
 
 func (s *Server) writer(ctx context.Context, conn net.PacketConn) {
-	_, port, err := net.SplitHostPort(s.Config.Server.Address)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	for {
 		select {
 		case b := <-s.write:
@@ -232,23 +402,22 @@ func (s *Server) writer(ctx context.Context, conn net.PacketConn) {
 				continue
 			}
 
-			nexthop := s.Router.Table().Get(h.dst)
-			if nexthop != nil {
-				rAddr, _ := net.ResolveUDPAddr("udp",
-					net.JoinHostPort(nexthop.String(), port))
-
-				if !s.Config.Server.Insecure {
-					b, err = s.Cipher.Encrypt(b)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-				}
+			p := s.route(h)
+			if p == nil {
+				continue
+			}
 
-				_, err = conn.WriteTo(b, rAddr)
-				if err != nil {
+			b, err = s.seal(conn, p, b)
+			if err != nil {
+				if err != errNoSession {
 					log.Println(err)
 				}
+				continue
+			}
+
+			_, err = conn.WriteTo(b, p.endpoint())
+			if err != nil {
+				log.Println(err)
 			}
 
 		case <-ctx.Done():
@@ -257,6 +426,53 @@ func (s *Server) writer(ctx context.Context, conn net.PacketConn) {
 	}
 }
 
+// reconciler repairs the drift between the kernel routes and
+// the routing table every reconcile interval
+func (s *Server) reconciler(ctx context.Context) {
+	interval := time.Duration(s.Config.Routing.ReconcileInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Router.Table().Reconcile(); err != nil {
+				log.Println(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setPolicy installs the routes at the configured routing table
+// and adds the rules which select the traffic of the vpn
+func (s *Server) setPolicy() error {
+	var rules []router.Rule
+	for _, r := range s.Config.Routing.Rules {
+		rule := router.Rule{Mark: r.Fwmark, Priority: r.Priority}
+		if r.From != "" {
+			_, src, err := net.ParseCIDR(r.From)
+			if err != nil {
+				return err
+			}
+			rule.Src = src
+		}
+
+		if rule.Mark == 0 && rule.Src == nil {
+			return errors.New("policy rule needs fwmark or from")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return s.Router.Table().SetPolicy(s.Config.Routing.Table, rules)
+}
+
 // updateRoutes updates routes
 func (s *Server) updateRoutes() {
 	irb := s.Config.GetIRB()
@@ -264,9 +480,22 @@ func (s *Server) updateRoutes() {
 	// add routes
 	for nexthop, subnets := range irb {
 		for _, subnet := range subnets {
-			_, dst, _ := net.ParseCIDR(subnet)
-			nexthop := net.ParseIP(nexthop)
-			err := s.Router.Table().Add(dst, nexthop)
+			_, dst, _ := net.ParseCIDR(subnet.Prefix)
+
+			// an exit node sends the internet traffic by its own default route
+			if s.node.Exit && router.IsDefault(dst) {
+				continue
+			}
+
+			route := router.Route{
+				NextHop: router.NextHop{
+					IP:     net.ParseIP(nexthop),
+					Weight: subnet.GetWeight(),
+				},
+				NetworkID: dst,
+				Metric:    subnet.Metric,
+			}
+			err := s.Router.Table().AddRoute(route)
 			if err != nil && !errors.Is(err, os.ErrExist) {
 				log.Println(err)
 			}
@@ -280,7 +509,7 @@ func (s *Server) updateRoutes() {
 			if _, ok := s.irb[nexthop]; !ok {
 				continue
 			}
-			diff := diffStrSlice(irb[nexthop], s.irb[nexthop])
+			diff := diffStrSlice(subnetPrefixes(irb[nexthop]), subnetPrefixes(s.irb[nexthop]))
 			for _, subnet := range diff {
 				_, dst, _ := net.ParseCIDR(subnet)
 				nexthop := net.ParseIP(nexthop)
@@ -413,22 +642,77 @@ func parseHeader(b []byte) (*header, error) {
 	h.version = int(b[0] >> 4)
 
 	if h.version == 4 {
+		if len(b) < 20 {
+			return nil, errors.New("small packet")
+		}
+
+		h.proto = b[9]
 		h.src = make(net.IP, net.IPv4len)
 		copy(h.src, b[12:16])
 		h.dst = make(net.IP, net.IPv4len)
 		copy(h.dst, b[16:20])
 
+		// the ports are only at the first fragment
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			h.parsePorts(b[int(b[0]&0x0f)*4:])
+		}
+
 		return h, nil
 	}
 
+	if len(b) < 40 {
+		return nil, errors.New("small packet")
+	}
+
+	h.proto = b[6]
 	h.src = make(net.IP, net.IPv6len)
 	copy(h.src, b[8:24])
 	h.dst = make(net.IP, net.IPv6len)
 	copy(h.dst, b[24:40])
 
+	h.parsePorts(b[40:])
+
 	return h, nil
 }
 
+// parsePorts sets the ports of tcp, udp and sctp
+func (h *header) parsePorts(b []byte) {
+	switch h.proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+		if len(b) < 4 {
+			return
+		}
+
+		h.srcPort = binary.BigEndian.Uint16(b[0:2])
+		h.dstPort = binary.BigEndian.Uint16(b[2:4])
+	}
+}
+
+// flowHash returns the 5-tuple hash, the packets of
+// a flow take the same path
+func (h *header) flowHash() uint32 {
+	f := fnv.New32a()
+	f.Write(h.src)
+	f.Write(h.dst)
+	f.Write([]byte{
+		h.proto,
+		byte(h.srcPort >> 8), byte(h.srcPort),
+		byte(h.dstPort >> 8), byte(h.dstPort),
+	})
+
+	return f.Sum32()
+}
+
+// subnetPrefixes returns the prefixes of the subnets
+func subnetPrefixes(subnets []config.Subnet) []string {
+	var prefixes []string
+	for _, subnet := range subnets {
+		prefixes = append(prefixes, subnet.Prefix)
+	}
+
+	return prefixes
+}
+
 func diffStrSlice(n, o []string) []string {
 	check := make(map[string]bool)
 	diff := []string{}
@@ -3,39 +3,55 @@ package server
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/mehrdadrad/radvpn/config"
+	"github.com/mehrdadrad/radvpn/crypto"
 
 	"github.com/vishvananda/netlink"
 )
 
 func TestInitCrypto(t *testing.T) {
-	cfg := &config.Config{
-		Crypto: struct {
-			Type string `yaml:"type"`
-			Key  string `yaml:"key"`
-		}{"gcm", "mykey"},
-	}
+	cfg := &config.Config{}
+	cfg.Crypto.Type = "gcm"
+	cfg.Crypto.Key = "mykey"
 
 	s := &Server{
 		Config: cfg,
 	}
 
 	err := s.initCrypto()
+	if err == nil {
+		t.Error("expected invalid key error but got nil")
+	}
+
+	cfg.Crypto.Key = "6368616e676520746869732070617373776f726420746f206120736563726574"
+
+	err = s.initCrypto()
+	if err != nil {
+		t.Error("expected err nil but got,", err)
+	}
+
+	cfg.Crypto.Type = "chacha20"
+
+	err = s.initCrypto()
 	if err != nil {
 		t.Error("expected err nil but got,", err)
 	}
 
-	cfg = &config.Config{
-		Crypto: struct {
-			Type string `yaml:"type"`
-			Key  string `yaml:"key"`
-		}{"unknown", "mykey"},
+	if _, ok := s.cipher.(*crypto.ChaCha20Poly1305); !ok {
+		t.Error("expected chacha20 cipher")
 	}
 
+	cfg = &config.Config{}
+	cfg.Crypto.Type = "unknown"
+	cfg.Crypto.Key = "mykey"
+
 	s = &Server{
 		Config: cfg,
 	}
@@ -124,6 +140,24 @@ func TestParseHeader(t *testing.T) {
 	if h.dst.String() != "192.229.150.190" {
 		t.Error("expected 192.229.150.190 but got,", h.src)
 	}
+
+	if h.proto != 17 || h.srcPort != 25755 || h.dstPort != 53 {
+		t.Error("expected udp 25755 -> 53 but got,", h.proto, h.srcPort, h.dstPort)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	a := &header{proto: 6, src: net.ParseIP("10.0.1.1"), dst: net.ParseIP("10.0.2.1"), srcPort: 40000, dstPort: 443}
+	b := *a
+
+	if a.flowHash() != b.flowHash() {
+		t.Error("expected the same hash for the same flow")
+	}
+
+	b.srcPort = 40001
+	if a.flowHash() == b.flowHash() {
+		t.Error("expected different hashes for the different flows")
+	}
 }
 
 func TestCross(t *testing.T) {
@@ -198,3 +232,46 @@ func testSetupTunInterface(t *testing.T) {
 		t.Error("expected having ip address but got nothing")
 	}
 }
+
+func TestInitCryptoPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	k, _ := crypto.GeneratePrivateKey()
+	path := filepath.Join(dir, "radvpn.key")
+	crypto.WritePrivateKeyFile(path, k)
+
+	cfg := &config.Config{}
+	cfg.Crypto.Type = "gcm"
+	cfg.Crypto.PrivateKeyFile = path
+
+	s := &Server{
+		Config: cfg,
+		node:   config.Node{Name: "node1", PublicKey: k.Public().String()},
+	}
+
+	if err := s.initCrypto(); err != nil {
+		t.Error("expected err nil but got,", err)
+	}
+
+	if s.key() == nil || *s.key() != k {
+		t.Error("expected private key loaded")
+	}
+
+	// the key isn't replaced by a reload without change
+	key := s.key()
+	if err := s.initCrypto(); err != nil || s.key() != key {
+		t.Error("expected the same private key but got,", err)
+	}
+
+	other, _ := crypto.GeneratePrivateKey()
+	s.node.PublicKey = other.Public().String()
+
+	if err := s.initCrypto(); err == nil {
+		t.Error("expected mismatched key error but got nil")
+	}
+}
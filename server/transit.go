@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// route returns the peer to send the packet to, the packets to a
+// node behind a relay (via) and the packets of a node behind a relay
+// are sent to the relay
+func (s *Server) route(h *header) *peer {
+	if s.Router == nil {
+		return nil
+	}
+
+	nexthop := s.Router.Table().GetByHash(h.dst, h.flowHash())
+	if nexthop == nil {
+		return nil
+	}
+
+	p := s.peers.get(nexthop.String())
+	if p == nil {
+		return nil
+	}
+
+	if relay := s.relay(p); relay != nil {
+		return relay
+	}
+
+	return p
+}
+
+// relay returns the relay peer of the peer or nil if the peer is
+// reached directly, the local node's relay takes precedence
+func (s *Server) relay(p *peer) *peer {
+	node := p.getNode()
+
+	via := s.node.Via
+	if via == "" || via == node.Name {
+		via = node.Via
+	}
+
+	if via == "" || via == node.Name || via == s.node.Name {
+		return nil
+	}
+
+	return s.peers.getByName(via)
+}
+
+// directPeers returns the peers which are not reached through a relay
+func (s *Server) directPeers() []*peer {
+	var direct []*peer
+
+	for _, p := range s.peers.all() {
+		if s.relay(p) == nil {
+			direct = append(direct, p)
+		}
+	}
+
+	return direct
+}
+
+// updateTransit enables the transit once the local node is a transit
+// node or it's the relay (via) of a node
+func (s *Server) updateTransit() {
+	var transit int32
+	if s.node.Transit {
+		transit = 1
+	}
+
+	for _, nodes := range s.Config.Nodes {
+		if nodes.Node.Via != "" && nodes.Node.Via == s.node.Name {
+			transit = 1
+		}
+	}
+
+	atomic.StoreInt32(&s.transit, transit)
+}
+
+// forward sends the packet from the peer to the node which owns
+// the destination (transit), it returns false once the packet
+// should be delivered locally. the packets are only forwarded
+// once the transit is enabled, otherwise the kernel forwarding
+// and firewall decide about them
+func (s *Server) forward(conn net.PacketConn, from *peer, b []byte) bool {
+	if atomic.LoadInt32(&s.transit) == 0 {
+		return false
+	}
+
+	h, err := parseHeader(b)
+	if err != nil {
+		return false
+	}
+
+	p := s.route(h)
+	if p == nil {
+		return false
+	}
+
+	// split horizon, the packet doesn't go back to the sender
+	if p == from {
+		return true
+	}
+
+	if !decTTL(b) {
+		return true
+	}
+
+	b, err = s.seal(conn, p, b)
+	if err != nil {
+		if err != errNoSession {
+			log.Println(err)
+		}
+		return true
+	}
+
+	if _, err := conn.WriteTo(b, p.endpoint()); err != nil {
+		log.Println(err)
+	}
+
+	return true
+}
+
+// decTTL decrements the ipv4 ttl or the ipv6 hop limit, it returns
+// false once the packet has expired
+func decTTL(b []byte) bool {
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if b[8] <= 1 || ihl < 20 || len(b) < ihl {
+			return false
+		}
+
+		b[8]--
+
+		// header checksum
+		b[10], b[11] = 0, 0
+		binary.BigEndian.PutUint16(b[10:12], checksum(b[:ihl]))
+
+		return true
+	case 6:
+		if len(b) < 40 || b[7] <= 1 {
+			return false
+		}
+
+		b[7]--
+
+		return true
+	}
+
+	return false
+}
+
+// checksum returns the internet checksum (rfc 1071)
+func checksum(b []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
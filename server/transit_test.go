@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/mehrdadrad/radvpn/router"
+)
+
+func testIPv4Packet(src, dst string, ttl byte) []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45
+	b[3] = 28
+	b[8] = ttl
+	b[9] = 17
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+
+	sum := checksum(b[:20])
+	b[10], b[11] = byte(sum>>8), byte(sum)
+
+	return b
+}
+
+func TestDecTTL(t *testing.T) {
+	b := testIPv4Packet("10.0.1.1", "10.0.3.1", 64)
+
+	if !decTTL(b) || b[8] != 63 {
+		t.Fatal("expected ttl 63 but got,", b[8])
+	}
+
+	if checksum(b[:20]) != 0 {
+		t.Error("invalid header checksum")
+	}
+
+	b = testIPv4Packet("10.0.1.1", "10.0.3.1", 1)
+	if decTTL(b) {
+		t.Error("expected expired packet")
+	}
+
+	b6 := make([]byte, 40)
+	b6[0], b6[7] = 0x60, 2
+	if !decTTL(b6) || b6[7] != 1 || decTTL(b6) {
+		t.Error("unexpected hop limit,", b6[7])
+	}
+}
+
+func TestTransit(t *testing.T) {
+	servers := testServers(t, 3)
+	s1, s2, s3 := servers[0], servers[1], servers[2]
+
+	// node3 is behind node2
+	s1.Config.Nodes[2].Node.Via = "node2"
+	for i, s := range servers {
+		s.node = s.Config.Nodes[i].Node
+		s.updatePeers()
+	}
+
+	_, dst, _ := net.ParseCIDR("10.0.3.0/24")
+	for _, s := range servers {
+		s.Router = router.New(context.Background())
+		s.Router.Table().Add(dst, net.ParseIP("192.168.55.30"))
+	}
+
+	testHandshake(t, s1, s2)
+	testHandshake(t, s2, s3)
+
+	if p := s1.relay(s1.peers.get("192.168.55.30")); p == nil || p.node.Name != "node2" {
+		t.Fatal("expected relay node2 but got,", p)
+	}
+
+	if p := s2.relay(s2.peers.get("192.168.55.30")); p != nil {
+		t.Fatal("expected no relay at the relay but got,", p.node.Name)
+	}
+
+	b := testIPv4Packet("10.0.1.1", "10.0.3.1", 64)
+	h, _ := parseHeader(b)
+
+	p := s1.route(h)
+	if p == nil || p.node.Name != "node2" {
+		t.Fatal("expected node2 but got,", p)
+	}
+
+	c1, c2, c3 := &testConn{}, &testConn{}, &testConn{}
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.168.55.10"), Port: 8085}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("192.168.55.20"), Port: 8085}
+
+	sealed, err := s1.seal(c1, p, b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	out, err := s2.handle(c2, addr1, sealed)
+	if err != nil || out != nil {
+		t.Fatal("expected forwarded packet but got,", out, err)
+	}
+
+	if len(c2.out) != 1 {
+		t.Fatal("expected one forwarded packet but got,", len(c2.out))
+	}
+
+	out, err = s3.handle(c3, addr2, c2.out[0])
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(out) != len(b) || out[8] != 63 || !net.IP(out[16:20]).Equal(net.ParseIP("10.0.3.1")) {
+		t.Error("expected the packet with ttl 63 but got,", out)
+	}
+
+	// the expired packet is dropped at the relay
+	sealed, _ = s1.seal(c1, p, testIPv4Packet("10.0.1.1", "10.0.3.1", 1))
+	c2.out = nil
+	s2.handle(c2, addr1, sealed)
+	if len(c2.out) != 0 {
+		t.Error("expected dropped packet")
+	}
+
+	// the node isn't a relay anymore, the packet is delivered locally
+	s2.Config.Nodes[2].Node.Via = ""
+	s2.updatePeers()
+
+	sealed, _ = s1.seal(c1, p, b)
+	out, err = s2.handle(c2, addr1, sealed)
+	if err != nil || out == nil || len(c2.out) != 0 {
+		t.Error("expected the packet delivered locally but got,", out, err)
+	}
+
+	// the explicit transit node
+	s2.node.Transit = true
+	s2.updatePeers()
+
+	sealed, _ = s1.seal(c1, p, b)
+	if out, _ = s2.handle(c2, addr1, sealed); out != nil || len(c2.out) != 1 {
+		t.Error("expected forwarded packet but got,", out)
+	}
+}